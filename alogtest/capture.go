@@ -0,0 +1,188 @@
+package alogtest
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tillberg/alog"
+	"github.com/tillberg/alog/internal/linebuf"
+)
+
+// A Record is a completed line captured by a Capture.
+type Record struct {
+	Time    time.Time
+	Level   alog.Level
+	Prefix  string
+	Message string
+	Fields  []alog.Field // fields added by the context-aware logging functions
+}
+
+// Text returns the prefix and message of the record together.
+func (r Record) Text() string {
+	return r.Prefix + r.Message
+}
+
+func (r Record) uncolorized() Record {
+	r.Prefix = string(alog.Uncolorize([]byte(r.Prefix)))
+	r.Message = string(alog.Uncolorize([]byte(r.Message)))
+	return r
+}
+
+// A Capture records the completed lines written to it, either by a Logger
+// (as an alog.LineWriter) or as plain text written to it as an io.Writer.
+type Capture struct {
+	Logger *alog.Logger // a Logger that writes to the Capture, with no prefix
+
+	mutex   sync.Mutex
+	records []Record
+	lines   linebuf.Buffer
+	changed chan struct{}
+}
+
+// NewCapture returns a new Capture, along with a Logger wired to it.
+func NewCapture() *Capture {
+	c := &Capture{changed: make(chan struct{})}
+	c.Logger = alog.New(c, "", 0)
+	return c
+}
+
+// Redirect sends the output of alog.DefaultLogger to a new Capture until the
+// end of the test, when the previous output, prefix, flags and color setting
+// are restored. The Capture's Logger is alog.DefaultLogger.
+func Redirect(t testing.TB) *Capture {
+	c := &Capture{changed: make(chan struct{}), Logger: alog.DefaultLogger}
+	output, prefix, flags, color := alog.Writer(), alog.Prefix(), alog.Flags(), alog.ColorEnabled()
+	alog.SetOutput(c)
+	t.Cleanup(func() {
+		alog.SetOutput(output)
+		alog.SetPrefix(prefix)
+		alog.SetFlags(flags)
+		alog.DefaultLogger.SetColorEnabled(color)
+	})
+	return c
+}
+
+func (c *Capture) addLocked(record Record) {
+	c.records = append(c.records, record)
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// WriteLine implements alog.LineWriter.
+func (c *Capture) WriteLine(line *alog.Line) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addLocked(Record{Time: line.Time, Level: line.Level, Prefix: string(line.Prefix), Message: string(line.Message), Fields: line.Fields})
+	return nil
+}
+
+// Write implements io.Writer.
+func (c *Capture) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(p), c.lines.Add(p, func(text []byte) error {
+		c.addLocked(Record{Time: time.Now(), Message: string(text)})
+		return nil
+	})
+}
+
+// Records returns the lines captured so far, with ANSI escapes removed.
+func (c *Capture) Records() []Record {
+	var records []Record
+	for _, record := range c.ColoredRecords() {
+		records = append(records, record.uncolorized())
+	}
+	return records
+}
+
+// ColoredRecords returns the lines captured so far, including any ANSI
+// escapes.
+func (c *Capture) ColoredRecords() []Record {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Record{}, c.records...)
+}
+
+// Lines returns the text (prefix and message) of each line captured so far,
+// with ANSI escapes removed.
+func (c *Capture) Lines() []string {
+	var lines []string
+	for _, record := range c.Records() {
+		lines = append(lines, record.Text())
+	}
+	return lines
+}
+
+// Messages returns the message of each line captured so far, without its
+// prefix and with ANSI escapes removed.
+func (c *Capture) Messages() []string {
+	var messages []string
+	for _, record := range c.Records() {
+		messages = append(messages, record.Message)
+	}
+	return messages
+}
+
+// Reset discards all of the lines captured so far.
+func (c *Capture) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.records = nil
+}
+
+// WaitFor waits up to timeout for a line whose text (with ANSI escapes
+// removed) matches pattern, returning the first such line. Lines captured
+// before WaitFor was called are considered as well.
+func (c *Capture) WaitFor(pattern string, timeout time.Duration) (Record, error) {
+	rgx, err := regexp.Compile(pattern)
+	if err != nil {
+		return Record{}, err
+	}
+	deadline := time.After(timeout)
+	next := 0
+	for {
+		c.mutex.Lock()
+		if next > len(c.records) {
+			// The Capture was Reset
+			next = 0
+		}
+		records := c.records[next:]
+		changed := c.changed
+		c.mutex.Unlock()
+		for _, record := range records {
+			if plain := record.uncolorized(); rgx.MatchString(plain.Text()) {
+				return plain, nil
+			}
+		}
+		next += len(records)
+		select {
+		case <-changed:
+		case <-deadline:
+			return Record{}, fmt.Errorf("alogtest: no line matching %q after %v", pattern, timeout)
+		}
+	}
+}
+
+// AssertNoPartialLines fails the test if the Capture's Logger, or any plain
+// text written to the Capture, has been left with an unfinished line.
+func (c *Capture) AssertNoPartialLines(t testing.TB) bool {
+	t.Helper()
+	partial := c.Logger.PartialLine()
+	if partial == "" {
+		c.mutex.Lock()
+		partial = string(c.lines.Partial())
+		c.mutex.Unlock()
+	}
+	if partial != "" {
+		t.Errorf("alogtest: unfinished line left dangling: %q", partial)
+		return false
+	}
+	return true
+}
+
+var _ alog.LineWriter = (*Capture)(nil)
+var _ io.Writer = (*Capture)(nil)
@@ -0,0 +1,99 @@
+package alogtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tillberg/alog"
+)
+
+// fakeTB records the errors reported to it instead of failing the test.
+type fakeTB struct {
+	testing.TB
+	errors []string
+}
+
+func (t *fakeTB) Helper() {}
+
+func (t *fakeTB) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCapture(t *testing.T) {
+	assert := assert.New(t)
+	c := NewCapture()
+	c.Logger.SetPrefix("@(green:$$) ")
+	c.Logger.EnableColorTemplate()
+	c.Logger.Printf("hello @(red:world)\nhow are ")
+	c.Logger.Printf("you?\nleft over")
+	assert.Equal([]string{"$$ hello world", "$$ how are you?"}, c.Lines())
+	records := c.ColoredRecords()
+	assert.Equal("\033[32m$$\033[39m ", records[0].Prefix)
+	assert.Equal("hello \033[31mworld\033[39m", records[0].Message)
+	assert.False(records[0].Time.IsZero())
+	fakeT := &fakeTB{}
+	assert.False(c.AssertNoPartialLines(fakeT))
+	assert.Equal([]string{`alogtest: unfinished line left dangling: "left over"`}, fakeT.errors)
+	c.Logger.Print("\n")
+	assert.True(c.AssertNoPartialLines(t))
+	assert.Equal("left over", c.Messages()[2])
+}
+
+func TestCaptureFatalLevels(t *testing.T) {
+	assert := assert.New(t)
+	alog.SetFatalPanics(true)
+	defer alog.SetFatalPanics(false)
+	c := NewCapture()
+	c.Logger.Print("info\n")
+	assert.Panics(func() { c.Logger.FatalCodef(2, "fatal\n") })
+	assert.Panics(func() { c.Logger.Panicln("panicked") })
+	var levels []alog.Level
+	for _, record := range c.Records() {
+		levels = append(levels, record.Level)
+	}
+	assert.Equal([]alog.Level{alog.LevelInfo, alog.LevelError, alog.LevelError}, levels)
+}
+
+func TestCaptureFields(t *testing.T) {
+	assert := assert.New(t)
+	c := NewCapture()
+	ctx := alog.WithFields(alog.NewContext(context.Background(), c.Logger), "request_id", "r1")
+	alog.InfoContext(ctx, "handled")
+	records := c.Records()
+	assert.Equal("handled", records[0].Message)
+	assert.Equal([]alog.Field{{Key: "request_id", Value: "r1"}}, records[0].Fields)
+}
+
+func TestCaptureWaitFor(t *testing.T) {
+	assert := assert.New(t)
+	c := NewCapture()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Logger.Log("server listening on :8080")
+	}()
+	record, err := c.WaitFor("listening on :\\d+", time.Second)
+	assert.NoError(err)
+	assert.Equal("server listening on :8080", record.Message)
+	_, err = c.WaitFor("never", 10*time.Millisecond)
+	assert.Error(err)
+}
+
+func TestRedirect(t *testing.T) {
+	assert := assert.New(t)
+	previous, prefix, flags, color := alog.Writer(), alog.Prefix(), alog.Flags(), alog.ColorEnabled()
+	t.Run("redirected", func(t *testing.T) {
+		c := Redirect(t)
+		alog.SetPrefix("> ")
+		alog.SetFlags(alog.Lshortfile)
+		alog.DefaultLogger.SetColorEnabled(!color)
+		alog.Log("to the capture")
+		assert.Equal([]string{"to the capture"}, c.Messages())
+	})
+	assert.Equal(previous, alog.Writer())
+	assert.Equal(prefix, alog.Prefix())
+	assert.Equal(flags, alog.Flags())
+	assert.Equal(color, alog.ColorEnabled())
+}
@@ -0,0 +1,26 @@
+// Package alogtest provides helpers for testing code that writes its output
+// through alog, including an in-memory terminal emulator that resolves temp
+// line redraws into what the user would actually see.
+package alogtest
+
+import (
+	"github.com/tillberg/alog/internal/vt"
+)
+
+// Terminal is an in-memory terminal emulator and an io.Writer. It interprets
+// the subset of control sequences that alog emits: carriage returns and
+// newlines, the cursor movements used in multiline mode, erasing, and SGR
+// color sequences. The screen has no fixed size; lines grow as they are
+// written. A Terminal is safe for concurrent use.
+type Terminal = vt.Terminal
+
+// Style is the set of SGR attributes applied to a Cell.
+type Style = vt.Style
+
+// A Cell is a single character position on the screen.
+type Cell = vt.Cell
+
+// NewTerminal returns an empty Terminal with the cursor at the top left.
+func NewTerminal() *Terminal {
+	return vt.New()
+}
@@ -0,0 +1,55 @@
+package alogtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tillberg/alog"
+)
+
+func TestTerminalBasics(t *testing.T) {
+	assert := assert.New(t)
+	term := NewTerminal()
+	term.Write([]byte("Hello, world\rJello\n\033[31mred\033[39m and \033[1;3"))
+	term.Write([]byte("2mbold green\033[0m   \n"))
+	assert.Equal([]string{"Jello, world", "red and bold green"}, term.Lines())
+	assert.Equal([]string{"Jello, world", "\033[0;31mred\033[0m and \033[0;1;32mbold green\033[0m"}, term.ColoredLines())
+	term.Write([]byte("\033[2A\033[1Gf\033[2B\r"))
+	assert.Equal("fello, world\nred and bold green", term.String())
+	row, col := term.Cursor()
+	assert.Equal(2, row)
+	assert.Equal(0, col)
+}
+
+func TestTerminalSinglelineTempLines(t *testing.T) {
+	assert := assert.New(t)
+	term := NewTerminal()
+	writer1 := alog.New(term, "", 0)
+	defer writer1.Close()
+	writer2 := alog.New(term, "", 0)
+	defer writer2.Close()
+	writer1.Print("Testing...")
+	writer2.Print("Writing Code...")
+	assert.Equal([]string{"Testing... | Writing Code..."}, term.Lines())
+	writer2.Print(" done.\n")
+	assert.Equal([]string{"Writing Code... done.", "Testing..."}, term.Lines())
+	writer1.Replace("Testing again")
+	assert.Equal([]string{"Writing Code... done.", "Testing again"}, term.Lines())
+}
+
+func TestTerminalMultilineTempLines(t *testing.T) {
+	assert := assert.New(t)
+	term := NewTerminal()
+	writer1 := alog.New(term, "", 0)
+	writer1.EnableMultilineMode()
+	writer1.Print("writer1...")
+	writer2 := alog.New(term, "", 0)
+	writer2.Print("writer2...")
+	writer1.Print(" 50 percent")
+	assert.Equal([]string{"writer1... 50 percent", "writer2..."}, term.Lines())
+	writer2.Print(" done.\n")
+	assert.Equal([]string{"writer2... done.", "writer1... 50 percent"}, term.Lines())
+	writer1.Close()
+	writer2.Close()
+	assert.Equal([]string{"writer2... done.", "writer1... 50 percent"}, term.Lines())
+}
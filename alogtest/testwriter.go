@@ -0,0 +1,96 @@
+package alogtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/tillberg/alog"
+	"github.com/tillberg/alog/internal/linebuf"
+)
+
+// A TestWriter sends the completed lines written to it to a test's log, so
+// that they are attributed to the test in `go test -v` output. As an
+// alog.LineWriter, it receives no temp line redraws. Lines are attributed to
+// the code that logged them rather than to alog.
+//
+// Anything logged at alog.LevelError fails the test, unless AllowErrors has
+// been called. Logging anything after the test has completed panics, as that
+// can no longer be reported against the test.
+type TestWriter struct {
+	t           testing.TB
+	mutex       sync.Mutex
+	lines       linebuf.Buffer
+	done        bool
+	allowErrors bool
+}
+
+// NewTestWriter returns a TestWriter that logs to t.
+func NewTestWriter(t testing.TB) *TestWriter {
+	w := &TestWriter{t: t}
+	t.Cleanup(func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.lines.Flush(func(text []byte) error {
+			w.t.Log(string(text))
+			return nil
+		})
+		w.done = true
+	})
+	return w
+}
+
+// NewTestLogger returns a Logger, with colors disabled, that writes to a new
+// TestWriter for t.
+func NewTestLogger(t testing.TB) *alog.Logger {
+	logger := alog.New(NewTestWriter(t), "", 0)
+	logger.DisableColor()
+	return logger
+}
+
+// AllowErrors stops lines logged at alog.LevelError from failing the test.
+func (w *TestWriter) AllowErrors() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.allowErrors = true
+}
+
+// HelperFunc returns the test's Helper method, which Loggers writing to w call
+// to mark their logging functions as test helpers.
+func (w *TestWriter) HelperFunc() func() {
+	return w.t.Helper
+}
+
+func (w *TestWriter) logLocked(level alog.Level, text []byte) {
+	w.t.Helper()
+	text = alog.Uncolorize(text)
+	if w.done {
+		panic(fmt.Sprintf("alogtest: logged after %s completed: %s", w.t.Name(), text))
+	}
+	if level >= alog.LevelError && !w.allowErrors {
+		w.t.Errorf("%s", text)
+	} else {
+		w.t.Log(string(text))
+	}
+}
+
+// WriteLine implements alog.LineWriter.
+func (w *TestWriter) WriteLine(line *alog.Line) error {
+	w.t.Helper()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.logLocked(line.Level, line.Bytes())
+	return nil
+}
+
+// Write implements io.Writer.
+func (w *TestWriter) Write(p []byte) (int, error) {
+	w.t.Helper()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(p), w.lines.Add(p, func(text []byte) error {
+		w.t.Helper()
+		w.logLocked(alog.LevelInfo, text)
+		return nil
+	})
+}
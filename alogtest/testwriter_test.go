@@ -0,0 +1,89 @@
+package alogtest
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tillberg/alog"
+)
+
+// fakeT mimics how testing.T attributes log calls to the first caller that
+// has not been marked as a helper.
+type fakeT struct {
+	*testing.T
+	helpers map[string]bool
+	logs    []string
+	errors  []string
+}
+
+func (f *fakeT) Helper() {
+	pc, _, _, _ := runtime.Caller(1)
+	f.helpers[runtime.FuncForPC(pc).Name()] = true
+}
+
+func (f *fakeT) caller() string {
+	pcs := make([]uintptr, 50)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !f.helpers[frame.Function] || !more {
+			return fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+		}
+	}
+}
+
+func (f *fakeT) Log(args ...interface{}) {
+	f.logs = append(f.logs, f.caller()+": "+fmt.Sprint(args...))
+}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, f.caller()+": "+fmt.Sprintf(format, args...))
+}
+
+func TestTestWriter(t *testing.T) {
+	assert := assert.New(t)
+	f := &fakeT{T: t, helpers: map[string]bool{}}
+	logger := NewTestLogger(f)
+	logger.SetPrefix("@(green:$$) ")
+	logger.EnableColorTemplate()
+	_, _, line, _ := runtime.Caller(0)
+	logger.Printf("partial ")
+	logger.Log("@(red:line)")
+	logger.Error("bad %v", fmt.Errorf("wrapped: %w", fmt.Errorf("cause")))
+	assert.Equal([]string{fmt.Sprintf("testwriter_test.go:%d: $$ partial line", line+2)}, f.logs)
+	assert.Equal([]string{
+		fmt.Sprintf("testwriter_test.go:%d: $$ bad wrapped", line+3),
+		fmt.Sprintf("testwriter_test.go:%d: $$   caused by: cause", line+3),
+	}, f.errors)
+}
+
+func TestTestWriterAfterCompletion(t *testing.T) {
+	var w *TestWriter
+	t.Run("inner", func(t *testing.T) {
+		w = NewTestWriter(t)
+		w.Write([]byte("during the test\n"))
+	})
+	assert.Panics(t, func() { w.Write([]byte("after the test\n")) })
+}
+
+func TestTestWriterFatal(t *testing.T) {
+	assert := assert.New(t)
+	alog.SetFatalPanics(true)
+	defer alog.SetFatalPanics(false)
+	f := &fakeT{T: t, helpers: map[string]bool{}}
+	logger := NewTestLogger(f)
+	_, _, line, _ := runtime.Caller(0)
+	assert.Panics(func() { logger.Fatalf("fatal %d\n", 1) })
+	assert.Panics(func() { logger.Panic("panicked\n") })
+	assert.Panics(func() { logger.Fatal("unfinished") })
+	logger.Close()
+	assert.Equal([]string(nil), f.logs)
+	assert.Equal([]string{
+		fmt.Sprintf("testwriter_test.go:%d: fatal 1", line+1),
+		fmt.Sprintf("testwriter_test.go:%d: panicked", line+2),
+		fmt.Sprintf("testwriter_test.go:%d: unfinished", line+4),
+	}, f.errors)
+}
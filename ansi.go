@@ -0,0 +1,69 @@
+package alog
+
+import (
+	"bytes"
+	"math"
+	"unicode/utf8"
+)
+
+// scanAnsiEscape returns the length of the ANSI color escape (ESC [ n;...;n m)
+// at the start of buf, or 0 if there isn't one, along with its first code and
+// whether it has more than one.
+func scanAnsiEscape(buf []byte) (length int, code int, multiple bool) {
+	if len(buf) < 4 || buf[0] != '\033' || buf[1] != '[' {
+		return 0, 0, false
+	}
+	i := 2
+	for {
+		start := i
+		for i < len(buf) && buf[i] >= '0' && buf[i] <= '9' {
+			if start == 2 && code <= math.MaxInt32 {
+				code = code*10 + int(buf[i]-'0')
+			}
+			i++
+		}
+		if i == start || i == len(buf) {
+			return 0, 0, false
+		}
+		if buf[i] == 'm' {
+			if code > math.MaxInt32 {
+				code = math.MaxInt32
+			}
+			return i + 1, code, multiple
+		}
+		if buf[i] != ';' {
+			return 0, 0, false
+		}
+		multiple = true
+		i++
+	}
+}
+
+// nextAnsiEscape returns the index of the next ANSI color escape in buf at or
+// after i, and its length, or len(buf) and 0 if there are no more.
+func nextAnsiEscape(buf []byte, i int) (index int, length int, code int, multiple bool) {
+	for i < len(buf) {
+		offset := bytes.IndexByte(buf[i:], '\033')
+		if offset == -1 {
+			break
+		}
+		i += offset
+		if length, code, multiple := scanAnsiEscape(buf[i:]); length > 0 {
+			return i, length, code, multiple
+		}
+		i++
+	}
+	return len(buf), 0, 0, false
+}
+
+// visibleRuneCount returns the number of runes in buf outside of ANSI color
+// escapes.
+func visibleRuneCount(buf []byte) int {
+	count := 0
+	for i := 0; i < len(buf); {
+		index, length, _, _ := nextAnsiEscape(buf, i)
+		count += utf8.RuneCount(buf[i:index])
+		i = index + length
+	}
+	return count
+}
@@ -0,0 +1,260 @@
+package alog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// AsyncPolicy determines what an AsyncWriter does with a write when its queue
+// is full.
+type AsyncPolicy int
+
+const (
+	AsyncBlock      AsyncPolicy = iota // wait for space in the queue
+	AsyncDropNewest                    // discard the new line
+	AsyncDropOldest                    // discard the oldest queued line to make room
+)
+
+var errAsyncWriterClosed = errors.New("Attempted to write to closed AsyncWriter.")
+
+var asyncWritersMutex sync.Mutex
+var asyncWriters = make(map[*AsyncWriter]bool)
+
+// The longest unfinished line kept in a single queue entry; longer lines are
+// queued in pieces so that a stream of updates without newlines (such as
+// progress output redrawn with \r) doesn't grow one entry without bound.
+const maxAsyncPartialLine = 64 << 10
+
+// An AsyncWriter queues writes and performs them on a separate goroutine, so
+// that a slow destination (a network filesystem, or a pipe that isn't being
+// read) doesn't hold up every goroutine that logs. Use it as the output of a
+// Logger in place of the destination. When writes are dropped because the
+// queue is full, a line saying how many lines were dropped is written in their
+// place, at the start of a line. The Fatal functions and Exit flush all
+// AsyncWriters before exiting.
+//
+// Only whole lines, from the start of a line to its newline, are ever dropped,
+// so that a temp line and the escapes that redraw it are dropped together or
+// not at all. In multiline mode, where temp lines are redrawn by moving the
+// cursor between lines, nothing is dropped and the policy is always
+// AsyncBlock.
+type AsyncWriter struct {
+	mutex        sync.Mutex
+	changed      *sync.Cond
+	out          io.Writer
+	policy       AsyncPolicy
+	queue        []asyncEntry
+	maxQueued    int
+	writing      bool
+	closed       bool
+	multiline    bool
+	droppedLines int
+	atLineStart  bool // whether the output written so far ends at a line start
+	queuedAtEnd  bool // whether the output queued so far ends at a line start
+	err          error
+}
+
+type asyncEntry struct {
+	data       []byte
+	startsLine bool
+}
+
+// NewAsyncWriter returns an AsyncWriter that writes to out, queueing up to
+// queueSize lines and applying policy when the queue is full. Writes that
+// continue an unfinished line are always added to it.
+func NewAsyncWriter(out io.Writer, queueSize int, policy AsyncPolicy) *AsyncWriter {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	w := &AsyncWriter{out: out, policy: policy, maxQueued: queueSize, atLineStart: true, queuedAtEnd: true}
+	w.changed = sync.NewCond(&w.mutex)
+	asyncWritersMutex.Lock()
+	asyncWriters[w] = true
+	asyncWritersMutex.Unlock()
+	go w.run()
+	return w
+}
+
+// setMultiline is called when multiline mode is turned on or off for Loggers
+// that write to w.
+func (w *AsyncWriter) setMultiline(flag bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.multiline = flag
+}
+
+// droppable returns whether entry could be dropped without leaving part of a
+// line, or of a redraw, behind.
+func (w *AsyncWriter) droppable(entry asyncEntry) bool {
+	return !w.multiline && entry.startsLine && bytes.HasSuffix(entry.data, bytesNewline)
+}
+
+// dropOldest drops the oldest droppable entry in the queue, returning false if
+// there isn't one.
+func (w *AsyncWriter) dropOldest() bool {
+	for i, entry := range w.queue {
+		if w.droppable(entry) {
+			w.dropped(entry.data)
+			w.queue = append(w.queue[:i:i], w.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Write queues a copy of p to be written.
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return 0, errAsyncWriterClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Queue whole lines, so that dropping doesn't leave partial lines behind
+	if last := len(w.queue) - 1; last >= 0 && !w.queuedAtEnd && len(w.queue[last].data) < maxAsyncPartialLine {
+		w.queue[last].data = append(w.queue[last].data, p...)
+		w.queuedAtEnd = bytes.HasSuffix(p, bytesNewline)
+		if len(w.queue) > w.maxQueued && w.droppable(w.queue[last]) {
+			// The line that was let in over the limit is complete
+			if w.policy == AsyncDropNewest || !w.dropOldest() {
+				w.dropped(w.queue[last].data)
+				w.queue = w.queue[:last]
+			}
+		}
+		w.changed.Broadcast()
+		return len(p), nil
+	}
+	entry := asyncEntry{data: append([]byte{}, p...), startsLine: w.queuedAtEnd}
+	for len(w.queue) >= w.maxQueued && w.policy != AsyncBlock && !w.multiline {
+		if w.droppable(entry) {
+			if w.policy == AsyncDropNewest || !w.dropOldest() {
+				w.dropped(p)
+				return len(p), nil
+			}
+		} else if entry.startsLine && len(w.queue) == w.maxQueued {
+			// Let the start of a line in over the limit, and decide what to
+			// drop once it is complete
+			break
+		} else if !w.dropOldest() {
+			break
+		}
+	}
+	for len(w.queue) >= w.maxQueued && (w.policy == AsyncBlock || w.multiline || !entry.startsLine) {
+		w.changed.Wait()
+		if w.closed {
+			return 0, errAsyncWriterClosed
+		}
+	}
+	w.queue = append(w.queue, entry)
+	w.queuedAtEnd = bytes.HasSuffix(p, bytesNewline)
+	w.changed.Broadcast()
+	return len(p), nil
+}
+
+// dropped counts the lines in a discarded write.
+func (w *AsyncWriter) dropped(p []byte) {
+	w.droppedLines += bytes.Count(p, bytesNewline)
+}
+
+// pending returns whether there is anything left to write: queued output, or
+// a notice of dropped lines that is due, which waits for the start of a line
+// unless w is closed.
+func (w *AsyncWriter) pending() bool {
+	return len(w.queue) > 0 || (w.droppedLines > 0 && (w.atLineStart || w.closed))
+}
+
+func (w *AsyncWriter) run() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for {
+		for !w.pending() && !w.closed {
+			w.changed.Wait()
+		}
+		if !w.pending() {
+			return
+		}
+		// Write everything that's queued in one go, with any notice of dropped
+		// lines at the first line start
+		var buf []byte
+		atLineStart := w.atLineStart
+		for _, entry := range w.queue {
+			if w.droppedLines > 0 && atLineStart {
+				buf = w.appendDroppedNotice(buf)
+			}
+			buf = append(buf, entry.data...)
+			atLineStart = bytes.HasSuffix(entry.data, bytesNewline)
+		}
+		if w.droppedLines > 0 && (atLineStart || w.closed) {
+			if !atLineStart {
+				buf = append(buf, byteNewline)
+			}
+			buf = w.appendDroppedNotice(buf)
+			atLineStart = true
+		}
+		w.queue = nil
+		w.writing = true
+		w.changed.Broadcast()
+		w.mutex.Unlock()
+		_, err := w.out.Write(buf)
+		w.mutex.Lock()
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		w.atLineStart = atLineStart
+		w.writing = false
+		w.changed.Broadcast()
+	}
+}
+
+func (w *AsyncWriter) appendDroppedNotice(buf []byte) []byte {
+	buf = append(buf, fmt.Sprintf("%d lines dropped\n", w.droppedLines)...)
+	w.droppedLines = 0
+	return buf
+}
+
+// Flush waits until everything queued so far has been written, and returns
+// the first error encountered while writing, if any.
+func (w *AsyncWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.pending() || w.writing {
+		w.changed.Wait()
+	}
+	return w.err
+}
+
+// Close flushes the queue and stops the AsyncWriter; subsequent writes fail.
+// It does not close the underlying writer.
+func (w *AsyncWriter) Close() error {
+	err := w.Flush()
+	w.mutex.Lock()
+	w.closed = true
+	w.changed.Broadcast()
+	// Wait for any notice of dropped lines that was waiting for a line start
+	for w.pending() || w.writing {
+		w.changed.Wait()
+	}
+	w.mutex.Unlock()
+	asyncWritersMutex.Lock()
+	delete(asyncWriters, w)
+	asyncWritersMutex.Unlock()
+	return err
+}
+
+// flushAsyncWriters flushes every open AsyncWriter.
+func flushAsyncWriters() {
+	asyncWritersMutex.Lock()
+	var writers []*AsyncWriter
+	for w := range asyncWriters {
+		writers = append(writers, w)
+	}
+	asyncWritersMutex.Unlock()
+	for _, w := range writers {
+		w.Flush()
+	}
+}
@@ -0,0 +1,136 @@
+package alog
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+const callerFlags = Lshortfile | Llongfile | Lrelfile | Lfunc
+
+var callerTrimPrefix string
+var callerMutex sync.Mutex
+var moduleRoots = make(map[string]string)
+var mainModulePath string
+var mainModulePathOnce sync.Once
+
+// SetCallerTrimPrefix sets a path prefix to strip from caller file names when
+// Lrelfile is set. When empty (the default), file names are made relative to
+// the root of the main module.
+func SetCallerTrimPrefix(prefix string) {
+	callerMutex.Lock()
+	defer callerMutex.Unlock()
+	callerTrimPrefix = prefix
+}
+
+// captureCaller records the file, line and function of the frame that
+// runtime.Caller(calldepth) would report to captureCaller's caller, plus any
+// frames skipped by the Logger.
+func (l *Logger) captureCaller(calldepth int) {
+	var pcs [1]uintptr
+	// +2 to skip runtime.Callers and captureCaller itself
+	if runtime.Callers(calldepth+l.callerSkip+2, pcs[:]) == 0 {
+		l.callerFile = "???"
+		l.callerLine = 0
+		l.callerFunc = "???"
+		l.callerPC = 0
+		return
+	}
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	l.callerFile = frame.File
+	l.callerLine = frame.Line
+	l.callerFunc = shortFuncName(frame.Function)
+	l.callerPC = pcs[0]
+	if l.flag&Lrelfile != 0 {
+		l.callerFile = relativeCallerFile(l.callerFile)
+	} else if l.flag&Lshortfile != 0 {
+		l.callerFile = filepath.Base(l.callerFile)
+	}
+}
+
+// shortFuncName strips the package path from a fully-qualified function name,
+// e.g. github.com/a/b.(*T).M becomes b.(*T).M.
+func shortFuncName(name string) string {
+	if name == "" {
+		return "???"
+	}
+	return name[strings.LastIndexByte(name, '/')+1:]
+}
+
+func getMainModulePath() string {
+	mainModulePathOnce.Do(func() {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			mainModulePath = info.Main.Path
+		}
+	})
+	return mainModulePath
+}
+
+func relativeCallerFile(file string) string {
+	callerMutex.Lock()
+	defer callerMutex.Unlock()
+	if callerTrimPrefix != "" {
+		if strings.HasPrefix(file, callerTrimPrefix) {
+			return strings.TrimLeft(file[len(callerTrimPrefix):], "/")
+		}
+		return file
+	}
+	modulePath := getMainModulePath()
+	// Binaries built with -trimpath report files as module/path/file.go
+	if modulePath != "" && strings.HasPrefix(file, modulePath+"/") {
+		return file[len(modulePath)+1:]
+	}
+	dir := filepath.Dir(file)
+	root, ok := moduleRoots[dir]
+	if !ok {
+		root = findModuleRoot(dir, modulePath)
+		moduleRoots[dir] = root
+	}
+	if root == "" {
+		return file
+	}
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return file
+	}
+	return rel
+}
+
+// findModuleRoot walks up from dir looking for the go.mod of the module
+// modulePath (or of any module, if modulePath is empty), returning its
+// directory or the empty string if there isn't one.
+func findModuleRoot(dir string, modulePath string) string {
+	for {
+		if path, ok := readModulePath(filepath.Join(dir, "go.mod")); ok {
+			if modulePath == "" || path == modulePath {
+				return dir
+			}
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func readModulePath(goModPath string) (string, bool) {
+	f, err := os.Open(goModPath)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "module ") {
+			return strings.Trim(strings.TrimSpace(line[len("module "):]), "\""), true
+		}
+	}
+	return "", true
+}
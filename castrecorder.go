@@ -0,0 +1,194 @@
+package alog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CastHeader is the header of an asciicast v2 recording.
+type CastHeader struct {
+	Version       int               `json:"version"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Timestamp     int64             `json:"timestamp,omitempty"`
+	IdleTimeLimit float64           `json:"idle_time_limit,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+}
+
+// A CastEvent is a single event in an asciicast v2 recording. Time is in
+// seconds since the start of the recording, and Type is "o" for output.
+type CastEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+// A CastRecorder is a writer that passes everything written to it through to
+// a terminal, while also recording it (including temp line redraws) with
+// timestamps in the asciicast v2 format used by asciinema. Use it as the
+// output of a Logger in place of the terminal.
+type CastRecorder struct {
+	mutex   sync.Mutex
+	out     io.Writer
+	cast    io.Writer
+	start   time.Time
+	pending []byte
+	err     error
+}
+
+// NewCastRecorder writes an asciicast header to cast and returns a
+// CastRecorder that records to it everything written through to out (which
+// may be nil, to only record). A width of 0 uses the width of out's terminal,
+// and a height of 0 uses 24.
+func NewCastRecorder(out io.Writer, cast io.Writer, width int, height int) (*CastRecorder, error) {
+	if width == 0 {
+		width = getTermWidth(out)
+	}
+	if height == 0 {
+		height = 24
+	}
+	header := CastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: time.Now().Unix(),
+		Env:       map[string]string{"TERM": os.Getenv("TERM")},
+	}
+	buf, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cast.Write(append(buf, '\n')); err != nil {
+		return nil, err
+	}
+	return &CastRecorder{out: out, cast: cast, start: time.Now()}, nil
+}
+
+// Write writes p through to the terminal and records it as an output event.
+// An error from recording doesn't fail the Write, but is returned by Close.
+func (r *CastRecorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := len(p)
+	var err error
+	if r.out != nil {
+		n, err = r.out.Write(p)
+	}
+	r.record(p[:n])
+	return n, err
+}
+
+// record writes an event for p, holding back any incomplete UTF-8 sequence at
+// its end, as each event's data must be valid UTF-8.
+func (r *CastRecorder) record(p []byte) {
+	buf := append(r.pending, p...)
+	end := len(buf)
+	for i := 1; i < utf8.UTFMax && i <= len(buf); i++ {
+		if utf8.RuneStart(buf[len(buf)-i]) {
+			if !utf8.FullRune(buf[len(buf)-i:]) {
+				end = len(buf) - i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte{}, buf[end:]...)
+	if end > 0 {
+		r.writeEvent(buf[:end])
+	}
+}
+
+func (r *CastRecorder) writeEvent(data []byte) {
+	if r.err != nil {
+		return
+	}
+	elapsed := float64(time.Since(r.start).Microseconds()) / 1e6
+	buf, err := json.Marshal([]interface{}{elapsed, "o", string(data)})
+	if err == nil {
+		_, err = r.cast.Write(append(buf, '\n'))
+	}
+	r.err = err
+}
+
+// Close records any output still being held back, and returns the first
+// error encountered while recording. It does not close either writer.
+func (r *CastRecorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.pending) > 0 {
+		r.writeEvent(r.pending)
+		r.pending = nil
+	}
+	return r.err
+}
+
+// ReadCast reads an asciicast v2 recording.
+func ReadCast(reader io.Reader) (*CastHeader, []CastEvent, error) {
+	decoder := json.NewDecoder(reader)
+	var header CastHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, nil, err
+	}
+	if header.Version != 2 {
+		return nil, nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+	var events []CastEvent
+	for {
+		var raw []interface{}
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var event CastEvent
+		var ok1, ok2, ok3 bool
+		if len(raw) == 3 {
+			event.Time, ok1 = raw[0].(float64)
+			event.Type, ok2 = raw[1].(string)
+			event.Data, ok3 = raw[2].(string)
+		}
+		if !ok1 || !ok2 || !ok3 {
+			return nil, nil, errors.New("malformed asciicast event")
+		}
+		events = append(events, event)
+	}
+	return &header, events, nil
+}
+
+// ReplayCast writes the output events of an asciicast v2 recording to w,
+// sleeping between them to reproduce the original timing sped up by the given
+// factor. A speed of 0 or less writes everything without delay. Pauses are
+// capped at the recording's idle_time_limit, if it has one.
+func ReplayCast(reader io.Reader, w io.Writer, speed float64) error {
+	header, events, err := ReadCast(reader)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	var offset, last float64
+	for _, event := range events {
+		if event.Type != "o" {
+			continue
+		}
+		if header.IdleTimeLimit > 0 && event.Time-last > header.IdleTimeLimit {
+			offset += event.Time - last - header.IdleTimeLimit
+		}
+		last = event.Time
+		if speed > 0 {
+			due := start.Add(time.Duration((event.Time - offset) / speed * float64(time.Second)))
+			time.Sleep(time.Until(due))
+		}
+		if _, err := io.WriteString(w, event.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package alog
+
+import (
+	"os/exec"
+	"time"
+)
+
+// RunCommand runs cmd, writing its stdout and stderr through children of l
+// (see Child) with the given prefixes, e.g. "@(dim:go build) " and
+// "@(dim:go build) @(red:!) ". Each stream's unfinished line is shown as a
+// temp line of its own, so progress output that redraws itself using
+// carriage returns is displayed as it would be in a terminal, without
+// disturbing l's other temp lines. Any unfinished lines are completed once
+// the command exits.
+//
+// It returns the command's exit code and how long it ran for, along with
+// the error from running it, which is an *exec.ExitError if the command ran
+// but exited with a non-zero code. The exit code is -1 if the command could
+// not be started or was killed by a signal.
+func (l *Logger) RunCommand(cmd *exec.Cmd, stdoutPrefix string, stderrPrefix string) (exitCode int, elapsed time.Duration, err error) {
+	stdout := l.Child(stdoutPrefix)
+	stderr := l.Child(stderrPrefix)
+	for _, child := range []*Logger{stdout, stderr} {
+		// The output arrives in arbitrary chunks
+		child.SetAutoNewlines(false)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	start := time.Now()
+	err = cmd.Run()
+	elapsed = time.Since(start)
+	stdout.Close()
+	stderr.Close()
+	exitCode = -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	return exitCode, elapsed, err
+}
+
+// RunCommand runs cmd with its output written through children of
+// DefaultLogger. See Logger.RunCommand.
+func RunCommand(cmd *exec.Cmd, stdoutPrefix string, stderrPrefix string) (exitCode int, elapsed time.Duration, err error) {
+	return DefaultLogger.RunCommand(cmd, stdoutPrefix, stderrPrefix)
+}
@@ -0,0 +1,293 @@
+package alog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Config holds settings for a Logger, as read from the ALOG_* environment
+// variables and the optional config file named by ALOG_CONFIG. Settings that
+// are nil (or zero) are left as they are.
+//
+// DefaultLogger is configured from the environment on startup, so that users
+// can turn off colors or temp lines in any program that uses alog:
+//
+//	ALOG_LEVEL=debug             level threshold (debug, info, warn, error)
+//	ALOG_LEVEL_<NAME>=warn       level threshold of the Loggers named <name>
+//	ALOG_FILTER=info,db=debug    level thresholds by name and package; see SetFilter
+//	ALOG_COLOR=false             color on/off
+//	ALOG_MULTILINE=true          multiline mode on/off
+//	ALOG_PARTIAL_LINES=false     temp lines on/off
+//	ALOG_PREFIX='{isodate} '     prefix template
+//	ALOG_TERM_WIDTH=120          terminal width
+//	ALOG_FORMAT=json             output format (text or json)
+//	ALOG_THEME=colorblind-safe   color theme; see Theme
+//
+// The config file has a "key = value" setting per line, with # comments,
+// where the keys are the lower case names of the variables without ALOG_,
+// e.g. "partial_lines = false", except that levels for names are given as
+// "level.<name> = warn". The environment takes precedence over the file. On
+// startup, unknown or invalid settings are skipped with a warning on stderr,
+// and the rest still apply.
+type Config struct {
+	Level        *Level
+	Levels       map[string]Level // by logger name; see SetLevelForName
+	Filter       string           // see SetFilter
+	Color        *bool
+	Multiline    *bool
+	PartialLines *bool
+	Prefix       *string
+	TermWidth    int
+	Format       string // "text" or "json"
+	Theme        string // see SetTheme
+}
+
+// set applies the setting key (in the config file's form) to c, leaving c as
+// it was if the key is unknown or the value invalid. Values other than
+// prefixes are trimmed of spaces.
+func (c *Config) set(key string, value string) error {
+	if strings.HasPrefix(key, "level.") {
+		level, err := ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		if c.Levels == nil {
+			c.Levels = map[string]Level{}
+		}
+		c.Levels[key[len("level."):]] = level
+		return nil
+	}
+	if key == "prefix" {
+		c.Prefix = &value
+		return nil
+	}
+	value = strings.TrimSpace(value)
+	switch key {
+	case "level":
+		level, err := ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		c.Level = &level
+	case "color", "multiline", "partial_lines":
+		flag, err := parseConfigBool(value)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "color":
+			c.Color = flag
+		case "multiline":
+			c.Multiline = flag
+		default:
+			c.PartialLines = flag
+		}
+	case "filter":
+		if _, err := parseFilter(value); err != nil {
+			return err
+		}
+		c.Filter = value
+	case "term_width":
+		width, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if width < 0 {
+			return fmt.Errorf("Invalid terminal width %d.", width)
+		}
+		c.TermWidth = width
+	case "format":
+		format := strings.ToLower(value)
+		if format != "text" && format != "json" {
+			return fmt.Errorf("Unknown output format %q.", value)
+		}
+		c.Format = format
+	case "theme":
+		if _, ok := lookupTheme(value); !ok {
+			return fmt.Errorf("Unknown theme %q.", value)
+		}
+		c.Theme = value
+	default:
+		return fmt.Errorf("Unknown setting %q.", key)
+	}
+	return nil
+}
+
+func parseConfigBool(value string) (*bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return &yes, nil
+	case "0", "false", "no", "off":
+		return &no, nil
+	}
+	return nil, fmt.Errorf("Invalid boolean %q.", value)
+}
+
+// ReadConfigFile reads the settings in the config file at path into c. Lines
+// that are malformed, or whose settings are unknown or invalid, are skipped,
+// and listed in the error returned once the rest have been read.
+func (c *Config) ReadConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var problems []string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		index := strings.IndexByte(line, '=')
+		if index == -1 {
+			problems = append(problems, fmt.Sprintf("%s:%d: Expected \"key = value\".", path, lineNum))
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:index]))
+		if err := c.set(key, unquoteConfigValue(strings.TrimSpace(line[index+1:]))); err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %v", path, lineNum, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return joinProblems(problems)
+}
+
+// unquoteConfigValue removes the quotes around value, if it has them, so that
+// values with leading or trailing spaces, like prefixes, can be given.
+func unquoteConfigValue(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+		}
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// ReadEnvironment reads the settings in the ALOG_* environment variables into
+// c, other than ALOG_CONFIG. Variables that are unknown or invalid are
+// skipped, and listed in the error returned once the rest have been read.
+func (c *Config) ReadEnvironment() error {
+	var problems []string
+	for _, kv := range os.Environ() {
+		index := strings.IndexByte(kv, '=')
+		name, value := kv[:index], kv[index+1:]
+		if !strings.HasPrefix(name, "ALOG_") || name == "ALOG_CONFIG" {
+			continue
+		}
+		key := strings.ToLower(name[len("ALOG_"):])
+		if strings.HasPrefix(key, "level_") {
+			key = "level." + key[len("level_"):]
+		}
+		if err := c.set(key, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	sort.Strings(problems)
+	return joinProblems(problems)
+}
+
+// joinProblems returns an error listing problems, or nil if there are none.
+func joinProblems(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, " "))
+}
+
+// ConfigFromEnvironment returns the settings in the config file named by
+// ALOG_CONFIG, if it is set, overridden by those in the ALOG_* environment
+// variables. Any settings that can't be read are listed in the error, and the
+// rest are returned anyway.
+func ConfigFromEnvironment() (*Config, error) {
+	c := &Config{}
+	var problems []string
+	if path := os.Getenv("ALOG_CONFIG"); path != "" {
+		if err := c.ReadConfigFile(path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if err := c.ReadEnvironment(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return c, joinProblems(problems)
+}
+
+// Apply applies the settings in c to l, using the same setters as code
+// would. For DefaultLogger, c.Filter and then c.Levels are set as the global
+// filter (see SetFilter and SetLevelForName); any other Logger gets a filter
+// of its own instead, which applies to it and to the Loggers created from it
+// afterwards, and takes precedence over the global one. With the json format,
+// l writes JSONLine objects to its current output instead of text, unless its
+// output is already a LineWriter.
+func (c *Config) Apply(l *Logger) {
+	if c.Level != nil {
+		l.SetLevel(*c.Level)
+	}
+	if l == DefaultLogger {
+		if c.Filter != "" {
+			SetFilter(c.Filter)
+		}
+		for name, level := range c.Levels {
+			SetLevelForName(name, level)
+		}
+	} else if c.Filter != "" || len(c.Levels) > 0 {
+		f, err := parseFilter(c.Filter)
+		if err != nil {
+			f, _ = parseFilter("")
+		}
+		for name, level := range c.Levels {
+			f.setLevel(name, level)
+		}
+		l.setFilter(f)
+	}
+	if c.Color != nil {
+		l.SetColorEnabled(*c.Color)
+	}
+	if c.Multiline != nil {
+		l.SetMultilineEnabled(*c.Multiline)
+	}
+	if c.PartialLines != nil {
+		l.SetPartialLinesEnabled(*c.PartialLines)
+	}
+	if c.Prefix != nil {
+		l.SetPrefix(*c.Prefix)
+	}
+	if c.Theme != "" {
+		l.SetTheme(c.Theme)
+	}
+	if c.TermWidth != 0 {
+		l.SetTerminalWidth(c.TermWidth)
+	}
+	if c.Format == "json" {
+		if _, ok := l.out.(LineWriter); !ok {
+			l.SetOutput(NewJSONWriter(l.out))
+		}
+	}
+}
+
+// configureFromEnvironment applies the settings from ConfigFromEnvironment
+// to l, warning on w about any that were skipped, so that an unknown or
+// mistyped variable doesn't cost the user the rest of their settings.
+func configureFromEnvironment(l *Logger, w io.Writer) {
+	c, err := ConfigFromEnvironment()
+	if err != nil {
+		fmt.Fprintf(w, "alog: ignoring settings: %v\n", err)
+	}
+	c.Apply(l)
+}
+
+func init() {
+	configureFromEnvironment(DefaultLogger, os.Stderr)
+}
@@ -0,0 +1,219 @@
+package alog
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type contextKey int
+
+const (
+	loggerContextKey contextKey = iota
+	fieldsContextKey
+)
+
+// A Field is a key/value pair attached to a line, such as a request ID.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+var contextKeysMutex sync.Mutex
+var contextKeys []Field // Value is the context key
+
+// NewContext returns a copy of ctx that carries l, for FromContext.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, l)
+}
+
+// FromContext returns the Logger carried by ctx, or DefaultLogger if there
+// isn't one.
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerContextKey).(*Logger); ok {
+			return l
+		}
+	}
+	return DefaultLogger
+}
+
+// WithFields returns a copy of ctx that carries the given fields, as
+// alternating keys and values, in addition to any that ctx already carries.
+// The context-aware logging functions add them to each line, e.g.
+// WithFields(ctx, "request_id", id) turns "done" into "done request_id=…".
+// A field replaces any earlier field with the same key.
+func WithFields(ctx context.Context, keysAndValues ...interface{}) context.Context {
+	fields, _ := ctx.Value(fieldsContextKey).([]Field)
+	fields = append([]Field{}, fields...)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields = setField(fields, fmt.Sprint(keysAndValues[i]), keysAndValues[i+1])
+	}
+	return context.WithValue(ctx, fieldsContextKey, fields)
+}
+
+// RegisterContextKey makes the context-aware logging functions add a field
+// named name to each line whose context has a value for key. This is for
+// values put into contexts by other packages, such as trace IDs.
+func RegisterContextKey(name string, key interface{}) {
+	contextKeysMutex.Lock()
+	defer contextKeysMutex.Unlock()
+	contextKeys = setField(contextKeys, name, key)
+}
+
+// setField sets the value of key in fields, appending it if it's new.
+func setField(fields []Field, key string, value interface{}) []Field {
+	for i := range fields {
+		if fields[i].Key == key {
+			fields[i].Value = value
+			return fields
+		}
+	}
+	return append(fields, Field{Key: key, Value: value})
+}
+
+// contextFields returns the fields carried by ctx, registered keys first.
+func contextFields(ctx context.Context) []Field {
+	var fields []Field
+	contextKeysMutex.Lock()
+	for _, key := range contextKeys {
+		if value := ctx.Value(key.Value); value != nil {
+			fields = setField(fields, key.Key, value)
+		}
+	}
+	contextKeysMutex.Unlock()
+	own, _ := ctx.Value(fieldsContextKey).([]Field)
+	for _, field := range own {
+		fields = setField(fields, field.Key, field.Value)
+	}
+	return fields
+}
+
+// appendFields renders fields as dimmed " key=value" pairs, quoting values
+// that would otherwise be ambiguous.
+func appendFields(buf []byte, theme string, fields []Field) []byte {
+	if len(fields) == 0 {
+		return buf
+	}
+	var sb strings.Builder
+	for _, field := range fields {
+		value := fmt.Sprint(field.Value)
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		sb.WriteString(" " + field.Key + "=" + value)
+	}
+	return colorize(buf, theme, "muted", sb.String())
+}
+
+// addFields attaches fields to the current line.
+func (l *Logger) addFields(fields []Field) {
+	for _, field := range fields {
+		l.lineFields = setField(l.lineFields, field.Key, field.Value)
+	}
+}
+
+// hasPartialLine returns whether l (or for a tee, any of its sinks) has an
+// unfinished line.
+func (l *Logger) hasPartialLine() bool {
+	partial := len(l.buf) > 0
+	l.eachSink(func(sink *Logger) {
+		partial = partial || len(sink.buf) > 0
+	})
+	return partial
+}
+
+// watchContext finalizes the current partial line if ctx is cancelled before
+// the line is completed.
+func (l *Logger) watchContext(ctx context.Context) {
+	if ctx.Done() == nil || l.lineDone != nil || !l.hasPartialLine() {
+		return
+	}
+	done := make(chan struct{})
+	l.lineDone = done
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			ws := getWriterState(l.out)
+			ws.lock()
+			defer ws.unlock()
+			if l.lineDone == done && !l.isClosed {
+				l.intOutput(2, []byte(colorize(nil, l.getTheme(), "muted", " ["+ctx.Err().Error()+"]")), true)
+				l.intOutput(2, []byte("\n"), true)
+			}
+		}
+	}()
+}
+
+// endLineContext stops watching the context of the line that was just
+// completed.
+func (l *Logger) endLineContext() {
+	if l.lineDone != nil {
+		close(l.lineDone)
+		l.lineDone = nil
+	}
+}
+
+func (l *Logger) printContext(ctx context.Context, calldepth int, level Level, format string, v ...interface{}) {
+	l.helper()()
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	if !l.enabled(calldepth, level) {
+		return
+	}
+	l.startLevel(level)
+	l.addFields(contextFields(ctx))
+	v = l.wrapErrorArgs(format, v, level >= LevelError)
+	l.intOutput(calldepth, []byte(fmt.Sprintf(l.applyColorTemplates(format), v...)), true)
+	l.watchContext(ctx)
+}
+
+// PrintfContext is like Printf, but adds the fields carried by ctx to the
+// line. If the line is left unfinished, it is finalized when ctx is
+// cancelled, noting the reason.
+func (l *Logger) PrintfContext(ctx context.Context, format string, v ...interface{}) {
+	l.helper()()
+	l.printContext(ctx, 3, LevelInfo, format, v...)
+}
+
+// InfoContext is like Info, but adds the fields carried by ctx to the line.
+func (l *Logger) InfoContext(ctx context.Context, format string, v ...interface{}) {
+	l.helper()()
+	l.printContext(ctx, 3, LevelInfo, format+"\n", v...)
+}
+
+// ErrorContext is like Error, but adds the fields carried by ctx to the line.
+func (l *Logger) ErrorContext(ctx context.Context, format string, v ...interface{}) {
+	l.helper()()
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	l.printContext(ctx, 3, LevelError, format, v...)
+}
+
+// The global context-aware functions log to the Logger carried by ctx.
+
+func PrintfContext(ctx context.Context, format string, v ...interface{}) {
+	l := FromContext(ctx)
+	l.helper()()
+	l.printContext(ctx, 3, LevelInfo, format, v...)
+}
+
+func InfoContext(ctx context.Context, format string, v ...interface{}) {
+	l := FromContext(ctx)
+	l.helper()()
+	l.printContext(ctx, 3, LevelInfo, format+"\n", v...)
+}
+
+func ErrorContext(ctx context.Context, format string, v ...interface{}) {
+	l := FromContext(ctx)
+	l.helper()()
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	l.printContext(ctx, 3, LevelError, format, v...)
+}
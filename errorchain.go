@@ -0,0 +1,299 @@
+package alog
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const errorChainIndent = "  "
+
+// errorChain formats an error as its full chain of causes, one per line, when
+// used with the %E verb (or with %v and %s if all is set). Other verbs are
+// passed through to the error itself.
+type errorChain struct {
+	err      error
+	all      bool
+	maxDepth int
+	theme    string
+}
+
+func (c errorChain) Format(f fmt.State, verb rune) {
+	if verb == 'E' || (c.all && (verb == 'v' || verb == 's') && !f.Flag('+') && !f.Flag('#')) {
+		chain := appendErrorChain(nil, c.theme, c.err, c.maxDepth)
+		if width, ok := f.Width(); ok && width > VisibleStringLen(chain) {
+			padding := bytes.Repeat(bytesSpace, width-VisibleStringLen(chain))
+			if f.Flag('-') {
+				chain = append(chain, padding...)
+			} else {
+				chain = append(padding, chain...)
+			}
+		}
+		f.Write(chain)
+		return
+	}
+	fmt.Fprintf(f, formatDirective(f, verb), c.err)
+}
+
+// formatDirective reconstructs the directive (e.g. %-8.3v) that produced f.
+func formatDirective(f fmt.State, verb rune) string {
+	directive := []byte{'%'}
+	for _, flag := range "+-# 0" {
+		if f.Flag(int(flag)) {
+			directive = append(directive, byte(flag))
+		}
+	}
+	if width, ok := f.Width(); ok {
+		directive = strconv.AppendInt(directive, int64(width), 10)
+	}
+	if precision, ok := f.Precision(); ok {
+		directive = append(directive, '.')
+		directive = strconv.AppendInt(directive, int64(precision), 10)
+	}
+	return string(append(directive, string(verb)...))
+}
+
+// wrapErrorArgs returns v with the errors that format consumes with %E (or
+// with %v and %s if all is set) replaced by errorChains, so that other verbs
+// see the errors themselves. A nil consumed by %E is rendered as "<nil>". v
+// itself is not modified.
+func (l *Logger) wrapErrorArgs(format string, v []interface{}, all bool) []interface{} {
+	hasErrors := false
+	for _, arg := range v {
+		if _, ok := arg.(error); ok || arg == nil {
+			hasErrors = true
+			break
+		}
+	}
+	if !hasErrors {
+		return v
+	}
+	// An argument that is also given to %T is left as it is, so that %T shows
+	// its type
+	chained := make([]bool, len(v))
+	typed := make([]bool, len(v))
+	forEachFormatVerb(format, func(argNum int, verb rune) {
+		if argNum < 0 || argNum >= len(v) {
+			return
+		}
+		if verb == 'T' {
+			typed[argNum] = true
+		} else if verb == 'E' {
+			chained[argNum] = true
+		} else if all && (verb == 'v' || verb == 's') {
+			if _, ok := v[argNum].(error); ok {
+				chained[argNum] = true
+			}
+		}
+	})
+	var wrapped []interface{}
+	for i, arg := range v {
+		if !chained[i] || typed[i] {
+			continue
+		}
+		err, ok := arg.(error)
+		if !ok && arg != nil {
+			continue
+		}
+		if wrapped == nil {
+			wrapped = append([]interface{}{}, v...)
+		}
+		wrapped[i] = errorChain{err: err, all: all, maxDepth: l.getStackTraceDepth(), theme: l.getTheme()}
+	}
+	if wrapped == nil {
+		return v
+	}
+	return wrapped
+}
+
+// forEachFormatVerb calls fn with each verb in format and the number of the
+// argument that it consumes, following fmt's rules for flags, widths,
+// precisions and explicit argument indexes. Arguments used as a * width or
+// precision are skipped.
+func forEachFormatVerb(format string, fn func(argNum int, verb rune)) {
+	argNum := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0", format[i]) != -1 {
+			i++
+		}
+		argNum, i = parseArgIndex(format, i, argNum)
+		argNum, i = skipFormatNumber(format, i, argNum)
+		if i < len(format) && format[i] == '.' {
+			i++
+			argNum, i = parseArgIndex(format, i, argNum)
+			argNum, i = skipFormatNumber(format, i, argNum)
+		}
+		argNum, i = parseArgIndex(format, i, argNum)
+		if i >= len(format) {
+			break
+		}
+		verb, size := utf8.DecodeRuneInString(format[i:])
+		i += size - 1
+		if verb == '%' {
+			continue
+		}
+		fn(argNum, verb)
+		argNum++
+	}
+}
+
+// parseArgIndex parses an explicit argument index like [2] at format[i:],
+// returning the (zero-based) argument number that it selects and the index
+// after it, or argNum and i if there isn't one.
+func parseArgIndex(format string, i int, argNum int) (int, int) {
+	if i >= len(format) || format[i] != '[' {
+		return argNum, i
+	}
+	end := strings.IndexByte(format[i:], ']')
+	if end == -1 {
+		return argNum, i
+	}
+	n, err := strconv.Atoi(format[i+1 : i+end])
+	if err != nil {
+		return argNum, i + end + 1
+	}
+	return n - 1, i + end + 1
+}
+
+// skipFormatNumber skips a width or precision at format[i:], which consumes
+// an argument if it is a *.
+func skipFormatNumber(format string, i int, argNum int) (int, int) {
+	if i < len(format) && format[i] == '*' {
+		return argNum + 1, i + 1
+	}
+	for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+		i++
+	}
+	return argNum, i
+}
+
+// unwrapErrors returns the direct causes of err, following both the single and
+// the multiple error forms of Unwrap.
+func unwrapErrors(err error) []error {
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		return e.Unwrap()
+	case interface{ Unwrap() error }:
+		if cause := e.Unwrap(); cause != nil {
+			return []error{cause}
+		}
+	}
+	return nil
+}
+
+// errorStackFrames returns the stack trace attached to err, if any. Both
+// Callers() []uintptr and the StackTrace() method of github.com/pkg/errors
+// (whose frames are program counters) are supported.
+func errorStackFrames(err error) []StackFrame {
+	var pcs []uintptr
+	if e, ok := err.(interface{ Callers() []uintptr }); ok {
+		pcs = e.Callers()
+	} else if method := reflect.ValueOf(err).MethodByName("StackTrace"); method.IsValid() {
+		methodType := method.Type()
+		if methodType.NumIn() == 0 && methodType.NumOut() == 1 && methodType.Out(0).Kind() == reflect.Slice && methodType.Out(0).Elem().Kind() == reflect.Uintptr {
+			trace := method.Call(nil)[0]
+			for i := 0; i < trace.Len(); i++ {
+				pcs = append(pcs, uintptr(trace.Index(i).Uint()))
+			}
+		}
+	}
+	if len(pcs) == 0 {
+		return nil
+	}
+	var stack []StackFrame
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "runtime.goexit" {
+			stack = append(stack, StackFrame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	return stack
+}
+
+// appendErrorChain renders err and each of its causes on its own line, with
+// causes indented beneath the error that wraps them. The text that a wrapper
+// repeats from its cause (as fmt.Errorf with %w does) is left out, and
+// wrappers that add no text of their own are skipped entirely.
+func appendErrorChain(buf []byte, theme string, err error, maxDepth int) []byte {
+	if err == nil {
+		return append(buf, "<nil>"...)
+	}
+	buf = appendErrorNode(buf, theme, err, 0, nil, maxDepth)
+	// Drop the trailing newline so the chain can be used inline
+	return buf[:len(buf)-1]
+}
+
+func appendErrorNode(buf []byte, theme string, err error, depth int, pendingFrames []StackFrame, maxDepth int) []byte {
+	causes := unwrapErrors(err)
+	frames := errorStackFrames(err)
+	if len(frames) == 0 {
+		frames = pendingFrames
+	}
+	message := err.Error()
+	if len(causes) == 1 {
+		message = strings.TrimSuffix(message, causes[0].Error())
+		message = strings.TrimRight(message, ": \n")
+	} else if len(causes) > 1 {
+		var causeMessages []string
+		for _, cause := range causes {
+			causeMessages = append(causeMessages, cause.Error())
+		}
+		if message == strings.Join(causeMessages, "\n") {
+			message = ""
+		}
+	}
+	if message == "" && len(causes) > 0 {
+		for _, cause := range causes {
+			buf = appendErrorNode(buf, theme, cause, depth, frames, maxDepth)
+		}
+		return buf
+	}
+	indent := strings.Repeat(errorChainIndent, depth)
+	for i, line := range strings.Split(message, "\n") {
+		buf = append(buf, indent...)
+		if depth > 0 {
+			if i == 0 {
+				buf = colorize(buf, theme, "muted", "caused by: ")
+			} else {
+				buf = append(buf, "           "...)
+			}
+		}
+		buf = colorize(buf, theme, "error", line)
+		buf = append(buf, '\n')
+	}
+	if len(frames) > 0 {
+		buf = appendStackFrames(buf, theme, frames, indent+errorChainIndent, maxDepth)
+	}
+	for _, cause := range causes {
+		buf = appendErrorNode(buf, theme, cause, depth+1, nil, maxDepth)
+	}
+	return buf
+}
+
+// FormatError renders err and its chain of causes as indented, colored lines.
+func FormatError(err error) string {
+	return string(appendErrorChain(nil, DefaultLogger.getTheme(), err, DefaultLogger.stackTraceDepth))
+}
+
+// Err writes err and its chain of causes as indented, colored lines.
+func (l *Logger) Err(err error) {
+	l.helper()()
+	l.error(4, "%E", err)
+}
+
+func Err(err error) {
+	DefaultLogger.helper()()
+	DefaultLogger.error(4, "%E", err)
+}
@@ -0,0 +1,105 @@
+package alog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FatalError is the value that the Fatal functions panic with, instead of
+// exiting, when SetFatalPanics(true) is in effect.
+type FatalError struct {
+	Code int
+}
+
+func (e FatalError) Error() string {
+	return fmt.Sprintf("alog: fatal exit with code %d", e.Code)
+}
+
+var exitMutex sync.Mutex
+var exitFunc = os.Exit
+var exitHandlers []*exitHandler
+var fatalPanics = false
+
+type exitHandler struct {
+	handler func()
+}
+
+// SetExitFunc sets the function used by the Fatal functions to exit the
+// process. It defaults to os.Exit.
+func SetExitFunc(f func(code int)) {
+	exitMutex.Lock()
+	defer exitMutex.Unlock()
+	exitFunc = f
+}
+
+// RegisterExitHandler adds a function to be called by the Fatal functions and
+// Exit after all Loggers have been flushed, but before the process exits.
+// Handlers are called in the order they were registered, and may log. The
+// returned function unregisters the handler.
+func RegisterExitHandler(handler func()) (unregister func()) {
+	exitMutex.Lock()
+	defer exitMutex.Unlock()
+	h := &exitHandler{handler: handler}
+	exitHandlers = append(exitHandlers, h)
+	return func() {
+		exitMutex.Lock()
+		defer exitMutex.Unlock()
+		for i, other := range exitHandlers {
+			if other == h {
+				exitHandlers = append(exitHandlers[:i:i], exitHandlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// SetFatalPanics sets whether the Fatal functions panic with a FatalError
+// instead of exiting, which allows Fatal paths to be tested. Loggers are still
+// flushed and exit handlers are still run first.
+func SetFatalPanics(flag bool) {
+	exitMutex.Lock()
+	defer exitMutex.Unlock()
+	fatalPanics = flag
+}
+
+// Exit flushes all Loggers, runs the registered exit handlers and then exits
+// with the given code, just as the Fatal functions do after logging.
+func Exit(code int) {
+	osExit(code)
+}
+
+func osExit(code int) {
+	finalizeTempLines()
+	exitMutex.Lock()
+	handlers := append([]*exitHandler{}, exitHandlers...)
+	exit := exitFunc
+	panics := fatalPanics
+	exitMutex.Unlock()
+	for _, h := range handlers {
+		h.handler()
+	}
+	flushAsyncWriters()
+	if panics {
+		panic(FatalError{Code: code})
+	}
+	// Lock everything and hold the locks until we exit. Close (and flush) all Loggers,
+	// then exit with the given code.
+	// We only hold an RLock on the global mutex to prevent new Loggers from being
+	// added (and mutating the writers map) before we exit. And because use Lock
+	// would result in a deadlock when we try to RLock during a flush operation when
+	// we try to call getWriterState()
+	mutexGlobal.RLock()
+	for _, ws := range writers {
+		ws.lock()
+		ws.closeAll()
+	}
+	// Closing may have finished temp lines on AsyncWriters
+	flushAsyncWriters()
+	exit(code)
+	// A custom exit func might return, e.g. in tests
+	for _, ws := range writers {
+		ws.unlock()
+	}
+	mutexGlobal.RUnlock()
+}
@@ -0,0 +1,198 @@
+package alog
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A levelFilter sets level thresholds by logger name and package path. It is
+// never modified once it is active; changes replace it.
+type levelFilter struct {
+	level    *Level                     // for Loggers without a level of their own
+	levels   map[string]filterDirective // keyed by normalized pattern
+	pcLevels sync.Map                   // caches levelForPC by program counter
+}
+
+type filterDirective struct {
+	pattern string
+	level   Level
+}
+
+type pcLevel struct {
+	level Level
+	ok    bool
+}
+
+var activeFilter atomic.Pointer[levelFilter]
+var filterMutex sync.Mutex // serializes changes to activeFilter
+
+// parseFilter parses a filter spec: a comma-separated list of directives,
+// each either a level, which is the default, or "pattern=level".
+func parseFilter(spec string) (*levelFilter, error) {
+	f := &levelFilter{levels: map[string]filterDirective{}}
+	for _, directive := range strings.Split(spec, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		index := strings.IndexByte(directive, '=')
+		if index == -1 {
+			level, err := ParseLevel(directive)
+			if err != nil {
+				return nil, err
+			}
+			f.level = &level
+			continue
+		}
+		pattern := strings.Trim(strings.TrimSpace(directive[:index]), "/")
+		if pattern == "" {
+			return nil, fmt.Errorf("Missing name in filter directive %q.", directive)
+		}
+		level, err := ParseLevel(directive[index+1:])
+		if err != nil {
+			return nil, err
+		}
+		f.levels[normalizeLevelName(pattern)] = filterDirective{pattern: pattern, level: level}
+	}
+	return f, nil
+}
+
+// String returns the spec of the filter, with the directives sorted.
+func (f *levelFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	var directives []string
+	for _, directive := range f.levels {
+		directives = append(directives, directive.pattern+"="+directive.level.String())
+	}
+	sort.Strings(directives)
+	if f.level != nil {
+		directives = append([]string{f.level.String()}, directives...)
+	}
+	return strings.Join(directives, ",")
+}
+
+// levelFor returns the level of the most specific directive matching path,
+// i.e. of path itself or of the nearest of its ancestors, split at slashes.
+func (f *levelFilter) levelFor(path string) (Level, bool) {
+	for path != "" {
+		if directive, ok := f.levels[normalizeLevelName(path)]; ok {
+			return directive.level, true
+		}
+		index := strings.LastIndexByte(path, '/')
+		if index == -1 {
+			break
+		}
+		path = path[:index]
+	}
+	return LevelInfo, false
+}
+
+// hasLevels returns whether the filter sets levels for any names or packages.
+func (f *levelFilter) hasLevels() bool {
+	return f != nil && len(f.levels) > 0
+}
+
+// levelForName returns the level that the filter sets for Loggers named name.
+func (f *levelFilter) levelForName(name string) (Level, bool) {
+	if f == nil || name == "" || len(f.levels) == 0 {
+		return LevelInfo, false
+	}
+	return f.levelFor(name)
+}
+
+// levelForPC returns the level that the filter sets for the package of the
+// function containing pc.
+func (f *levelFilter) levelForPC(pc uintptr) (Level, bool) {
+	if cached, ok := f.pcLevels.Load(pc); ok {
+		return cached.(pcLevel).level, cached.(pcLevel).ok
+	}
+	var result pcLevel
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		result.level, result.ok = f.levelFor(packagePath(fn.Name()))
+	}
+	f.pcLevels.Store(pc, result)
+	return result.level, result.ok
+}
+
+// packagePath returns the package path of a fully-qualified function name,
+// e.g. github.com/a/b for github.com/a/b.(*T).M.
+func packagePath(funcName string) string {
+	slash := strings.LastIndexByte(funcName, '/')
+	if dot := strings.IndexByte(funcName[slash+1:], '.'); dot != -1 {
+		return funcName[:slash+1+dot]
+	}
+	return funcName
+}
+
+// SetFilter sets level thresholds by logger name and package path from a
+// spec like RUST_LOG's: a comma-separated list of directives, each either a
+// level, which applies to Loggers without a level of their own, or
+// "pattern=level", e.g. "info,db=debug,http/client=warn". A pattern matches
+// the Loggers with that name (see Named) and their descendants, such as
+// "db/pool" for "db", and otherwise output logged from the package with that
+// path and its subpackages. The most specific matching pattern wins, and a
+// Logger's name takes precedence over the package path.
+//
+// Levels for names and packages take precedence over levels set with
+// SetLevel, and output below them is discarded before it is formatted. The
+// filter can be changed at any time; it replaces any filter set before,
+// including levels set with SetLevelForName. If spec is invalid, the filter
+// is left as it was. DefaultLogger's filter is initially set from the
+// ALOG_FILTER environment variable (see Config).
+func SetFilter(spec string) error {
+	f, err := parseFilter(spec)
+	if err != nil {
+		return err
+	}
+	filterMutex.Lock()
+	defer filterMutex.Unlock()
+	activeFilter.Store(f)
+	return nil
+}
+
+// Filter returns the spec of the current filter, including any levels set
+// with SetLevelForName, in the form accepted by SetFilter.
+func Filter() string {
+	return activeFilter.Load().String()
+}
+
+// SetLevelForName sets the level threshold of the Loggers named name (see
+// Named), and of their descendants that have no level set for their own
+// names, by adding the directive "name=level" to the filter. Like other
+// filter directives, it takes precedence over levels set with SetLevel, so
+// that configuration can override the levels chosen in code.
+func SetLevelForName(name string, level Level) {
+	filterMutex.Lock()
+	defer filterMutex.Unlock()
+	f := &levelFilter{levels: map[string]filterDirective{}}
+	if old := activeFilter.Load(); old != nil {
+		f.level = old.level
+		for key, directive := range old.levels {
+			f.levels[key] = directive
+		}
+	}
+	f.setLevel(name, level)
+	activeFilter.Store(f)
+}
+
+// setLevel adds the directive "name=level" to f, which must not be active yet.
+func (f *levelFilter) setLevel(name string, level Level) {
+	name = strings.Trim(name, "/")
+	f.levels[normalizeLevelName(name)] = filterDirective{pattern: name, level: level}
+}
+
+// setFilter gives l (and the Loggers created from it from now on) a filter of
+// its own, which takes precedence over the global one.
+func (l *Logger) setFilter(f *levelFilter) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.filter = f
+	l.eachSink(func(sink *Logger) { sink.filter = f })
+}
@@ -0,0 +1,338 @@
+package alog
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tillberg/alog/internal/vt"
+)
+
+var htmlColorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// HTMLStyleSheet is the CSS for the classes used by HTMLWriter. It is included
+// in HTML documents, but must be provided separately for fragments.
+const HTMLStyleSheet = `pre.alog { background: #1e1e1e; color: #d4d4d4; padding: 0.5em; }
+.alog-bold { font-weight: bold; }
+.alog-dim { opacity: 0.6; }
+.alog-italic { font-style: italic; }
+.alog-underline { text-decoration: underline; }
+.alog-reverse { filter: invert(100%); }
+.alog-fg-black { color: #555555; }
+.alog-fg-red { color: #cd3131; }
+.alog-fg-green { color: #0dbc79; }
+.alog-fg-yellow { color: #e5e510; }
+.alog-fg-blue { color: #2472c8; }
+.alog-fg-magenta { color: #bc3fbc; }
+.alog-fg-cyan { color: #11a8cd; }
+.alog-fg-white { color: #e5e5e5; }
+.alog-fg-bright-black { color: #767676; }
+.alog-fg-bright-red { color: #f14c4c; }
+.alog-fg-bright-green { color: #23d18b; }
+.alog-fg-bright-yellow { color: #f5f543; }
+.alog-fg-bright-blue { color: #3b8eea; }
+.alog-fg-bright-magenta { color: #d670d6; }
+.alog-fg-bright-cyan { color: #29b8db; }
+.alog-fg-bright-white { color: #ffffff; }
+.alog-bg-black { background: #000000; }
+.alog-bg-red { background: #cd3131; }
+.alog-bg-green { background: #0dbc79; }
+.alog-bg-yellow { background: #e5e510; }
+.alog-bg-blue { background: #2472c8; }
+.alog-bg-magenta { background: #bc3fbc; }
+.alog-bg-cyan { background: #11a8cd; }
+.alog-bg-white { background: #e5e5e5; }
+.alog-bg-bright-black { background: #666666; }
+.alog-bg-bright-red { background: #f14c4c; }
+.alog-bg-bright-green { background: #23d18b; }
+.alog-bg-bright-yellow { background: #f5f543; }
+.alog-bg-bright-blue { background: #3b8eea; }
+.alog-bg-bright-magenta { background: #d670d6; }
+.alog-bg-bright-cyan { background: #29b8db; }
+.alog-bg-bright-white { background: #ffffff; }
+`
+
+// HTMLOptions configures an HTMLWriter.
+type HTMLOptions struct {
+	// Document writes a complete HTML document, including HTMLStyleSheet,
+	// rather than a <pre> fragment.
+	Document bool
+	// Title is the title of the document, if Document is set.
+	Title string
+	// ResolveScreen interprets cursor movements, so that multiline temp line
+	// redraws are resolved. Lines are then written whenever no temp lines are
+	// shown below them, and the rest of the screen on Close. Otherwise, all
+	// escapes besides SGR are dropped, and each line is written once it is
+	// complete, as it would appear after any carriage returns.
+	ResolveScreen bool
+}
+
+// An HTMLWriter converts alog's terminal output, including SGR colors and
+// styles, to HTML with CSS classes (see HTMLStyleSheet), and writes it to an
+// underlying writer. Close must be called to finish the HTML.
+type HTMLWriter struct {
+	mutex     sync.Mutex
+	w         io.Writer
+	options   HTMLOptions
+	screen    *vt.Terminal
+	spanStyle vt.Style
+	pending   []byte // an incomplete escape sequence, without ResolveScreen
+	started   bool
+	err       error
+}
+
+// NewHTMLWriter returns an HTMLWriter that writes HTML to w.
+func NewHTMLWriter(w io.Writer, options HTMLOptions) *HTMLWriter {
+	return &HTMLWriter{w: w, options: options, screen: vt.New()}
+}
+
+func (h *HTMLWriter) writeString(s string) {
+	if h.err == nil {
+		_, h.err = io.WriteString(h.w, s)
+	}
+}
+
+func (h *HTMLWriter) start() {
+	if h.started {
+		return
+	}
+	h.started = true
+	if h.options.Document {
+		h.writeString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + html.EscapeString(h.options.Title) + "</title>\n<style>\n" + HTMLStyleSheet + "</style>\n</head>\n<body>\n")
+	}
+	h.writeString("<pre class=\"alog\">")
+}
+
+// text writes s in style, opening and closing spans as needed.
+func (h *HTMLWriter) text(style vt.Style, s string) {
+	if style != h.spanStyle {
+		h.closeSpan()
+		if style != (vt.Style{}) {
+			h.writeString(htmlSpanStart(style))
+		}
+		h.spanStyle = style
+	}
+	h.writeString(html.EscapeString(s))
+}
+
+func (h *HTMLWriter) closeSpan() {
+	if h.spanStyle != (vt.Style{}) {
+		h.writeString("</span>")
+		h.spanStyle = vt.Style{}
+	}
+}
+
+// writeRow writes a line of the screen, without a newline, closing any span
+// at the end of it.
+func (h *HTMLWriter) writeRow(row []vt.Cell) {
+	h.start()
+	for start := 0; start < len(row); {
+		end := start + 1
+		for end < len(row) && row[end].Style == row[start].Style {
+			end++
+		}
+		var sb strings.Builder
+		for _, cell := range row[start:end] {
+			sb.WriteRune(cell.Rune)
+		}
+		h.text(row[start].Style, sb.String())
+		start = end
+	}
+	h.closeSpan()
+}
+
+// Write feeds p to the screen and converts the lines that are final to HTML.
+func (h *HTMLWriter) Write(p []byte) (int, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var final int
+	if h.options.ResolveScreen {
+		h.screen.Write(p)
+		row, col := h.screen.Cursor()
+		if col == 0 && h.screen.Height() <= row {
+			// Nothing is shown at or below the cursor, so no temp lines are
+			// left to redraw above it
+			final = row
+		}
+	} else {
+		h.screen.Write(h.stripEscapes(p))
+		// Without cursor movements, only the cursor's line can still change
+		final, _ = h.screen.Cursor()
+	}
+	for _, row := range h.screen.PopRows(final) {
+		h.writeRow(row)
+		h.writeString("\n")
+	}
+	return len(p), h.err
+}
+
+// stripEscapes returns p without any escape sequences besides SGR, or control
+// characters besides carriage returns, newlines and tabs. An incomplete escape
+// sequence at the end is held back until the next call.
+func (h *HTMLWriter) stripEscapes(p []byte) []byte {
+	buf := append(h.pending, p...)
+	h.pending = nil
+	var stripped []byte
+	for i := 0; i < len(buf); {
+		c := buf[i]
+		switch {
+		case c == '\033':
+			end := scanEscape(buf[i:])
+			if end == 0 {
+				h.pending = append([]byte{}, buf[i:]...)
+				return stripped
+			}
+			if end > 2 && buf[i+1] == '[' && buf[i+end-1] == 'm' {
+				stripped = append(stripped, buf[i:i+end]...)
+			}
+			i += end
+		case (c < 0x20 && c != '\r' && c != '\n' && c != '\t') || c == 0x7f:
+			i++
+		default:
+			stripped = append(stripped, c)
+			i++
+		}
+	}
+	return stripped
+}
+
+// scanEscape returns the length of the escape sequence at the start of buf,
+// or 0 if buf ends before it does.
+func scanEscape(buf []byte) int {
+	if len(buf) < 2 {
+		return 0
+	}
+	if buf[1] != '[' {
+		return 2
+	}
+	for i := 2; i < len(buf); i++ {
+		if buf[i] >= 0x40 && buf[i] <= 0x7e {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Close writes the rest of the screen, such as an unfinished line or temp
+// lines, and the end of the HTML. It does not close the underlying writer.
+func (h *HTMLWriter) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, row := range h.screen.PopRows(h.screen.Height()) {
+		if i > 0 {
+			h.writeString("\n")
+		}
+		h.writeRow(row)
+	}
+	h.screen.Reset()
+	h.pending = nil
+	h.start()
+	h.writeString("</pre>\n")
+	if h.options.Document {
+		h.writeString("</body>\n</html>\n")
+	}
+	return h.err
+}
+
+// htmlSpanStart returns the opening span tag for style.
+func htmlSpanStart(style vt.Style) string {
+	var classes, css []string
+	switch style.Intensity {
+	case 1:
+		classes = append(classes, "alog-bold")
+	case 2:
+		classes = append(classes, "alog-dim")
+	}
+	if style.Italic {
+		classes = append(classes, "alog-italic")
+	}
+	if style.Underline {
+		classes = append(classes, "alog-underline")
+	}
+	if style.Reverse {
+		classes = append(classes, "alog-reverse")
+	}
+	for _, color := range []struct{ params, kind, property string }{
+		{style.Foreground, "fg", "color"},
+		{style.Background, "bg", "background"},
+	} {
+		if color.params == "" {
+			continue
+		}
+		if class, ok := htmlColorClass(color.params); ok {
+			classes = append(classes, "alog-"+color.kind+"-"+class)
+		} else if rgb, ok := sgrColorRGB(color.params); ok {
+			css = append(css, color.property+": "+rgb)
+		}
+	}
+	tag := "<span"
+	if len(classes) > 0 {
+		tag += " class=\"" + strings.Join(classes, " ") + "\""
+	}
+	if len(css) > 0 {
+		tag += " style=\"" + strings.Join(css, "; ") + "\""
+	}
+	return tag + ">"
+}
+
+// htmlColorClass returns the class name suffix (e.g. "red" or "bright-red")
+// for one of the 16 basic colors.
+func htmlColorClass(params string) (string, bool) {
+	parts := strings.Split(params, ";")
+	code, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return "", false
+	}
+	if len(parts) == 3 && parts[1] == "5" {
+		if code < 8 {
+			return htmlColorNames[code], true
+		} else if code < 16 {
+			return "bright-" + htmlColorNames[code-8], true
+		}
+		return "", false
+	}
+	if len(parts) != 1 {
+		return "", false
+	}
+	switch {
+	case code >= 30 && code <= 37:
+		return htmlColorNames[code-30], true
+	case code >= 40 && code <= 47:
+		return htmlColorNames[code-40], true
+	case code >= 90 && code <= 97:
+		return "bright-" + htmlColorNames[code-90], true
+	case code >= 100 && code <= 107:
+		return "bright-" + htmlColorNames[code-100], true
+	}
+	return "", false
+}
+
+// sgrColorRGB returns the CSS color for a 256-color (38;5;n) or truecolor
+// (38;2;r;g;b) SGR color.
+func sgrColorRGB(params string) (string, bool) {
+	var values []int
+	for _, part := range strings.Split(params, ";") {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 || value > 255 {
+			return "", false
+		}
+		values = append(values, value)
+	}
+	if len(values) == 5 && values[1] == 2 {
+		return fmt.Sprintf("#%02x%02x%02x", values[2], values[3], values[4]), true
+	}
+	if len(values) != 3 || values[1] != 5 || values[2] < 16 {
+		return "", false
+	}
+	n := values[2]
+	if n >= 232 {
+		gray := 8 + 10*(n-232)
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray), true
+	}
+	levels := []int{0, 95, 135, 175, 215, 255}
+	n -= 16
+	return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[n/6%6], levels[n%6]), true
+}
@@ -0,0 +1,180 @@
+package alog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The latencies above which the middleware colors a request's latency as
+// medium and long.
+var (
+	HTTPMediumLatency = 100 * time.Millisecond
+	HTTPLongLatency   = time.Second
+)
+
+// How often the temp lines of in-flight requests are redrawn.
+var httpRefreshInterval = time.Second
+
+// responseRecorder wraps an http.ResponseWriter to record the status and the
+// number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The ResponseWriter does not support hijacking.")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// ResponseWriter.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// lineLogger returns a Logger with the same output and settings as l, for a
+// line of its own, i.e. a temp line of its own while it's unfinished.
+func (l *Logger) lineLogger() *Logger {
+	if len(l.sinks) == 0 {
+		return l.clone()
+	}
+	var sinks []*Logger
+	l.eachSink(func(sink *Logger) { sinks = append(sinks, sink.lineLogger()) })
+	return NewTee(sinks...)
+}
+
+// replaceLine replaces the partial line of l with text at level.
+func (l *Logger) replaceLine(level Level, text []byte) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.truncateBuf()
+	l.raiseLevel(level)
+	l.intOutput(2, text, true)
+}
+
+func httpStatusColor(status int) string {
+	switch {
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "warn"
+	case status >= 300:
+		return "info"
+	default:
+		return "success"
+	}
+}
+
+// Middleware returns an http.Handler that logs a line for each request
+// handled by next, with its method, path, status, the number of bytes in the
+// response body and its latency, colored using HTTPMediumLatency and
+// HTTPLongLatency. Lines for requests with 4xx and 5xx statuses are at
+// LevelWarn and LevelError respectively.
+//
+// If l shows partial lines, each request in flight is shown as a temp line
+// (one line per request in multiline mode) with its latency so far, which
+// turns into the permanent line once the request is complete; a request that
+// is hanging stands out. Handlers can log to l using the context-aware
+// functions with the request's context.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := l.lineLogger()
+		request := r.Method + " " + r.URL.RequestURI()
+		theme := l.getTheme()
+		rl.replaceLine(LevelInfo, colorize(nil, theme, "muted", request))
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		if rl.isPartialLinesEnabled() {
+			go func() {
+				defer close(stopped)
+				ticker := time.NewTicker(httpRefreshInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						text := colorize(nil, theme, "muted", request)
+						text = append(text, " "+FormatDurationColor(time.Since(start), HTTPMediumLatency, HTTPLongLatency)...)
+						rl.replaceLine(LevelInfo, text)
+					}
+				}
+			}()
+		} else {
+			close(stopped)
+		}
+		recorder := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			close(done)
+			<-stopped
+			elapsed := FormatDurationColor(time.Since(start), HTTPMediumLatency, HTTPLongLatency)
+			if err := recover(); err != nil {
+				text := colorize([]byte(request+" "), theme, "error", "panic")
+				text = append(text, " "+elapsed+" "...)
+				text = colorize(text, theme, "muted", fmt.Sprint(err))
+				rl.replaceLine(LevelError, append(text, '\n'))
+				panic(err)
+			}
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := LevelInfo
+			if status >= 500 {
+				level = LevelError
+			} else if status >= 400 {
+				level = LevelWarn
+			}
+			text := colorize([]byte(request+" "), theme, httpStatusColor(status), strconv.Itoa(status))
+			text = append(text, fmt.Sprintf(" %dB %s\n", recorder.bytes, elapsed)...)
+			rl.replaceLine(level, text)
+		}()
+		next.ServeHTTP(recorder, r.WithContext(NewContext(r.Context(), l)))
+	})
+}
+
+// Middleware returns an http.Handler that logs each request handled by next
+// to DefaultLogger. See Logger.Middleware.
+func Middleware(next http.Handler) http.Handler {
+	return DefaultLogger.Middleware(next)
+}
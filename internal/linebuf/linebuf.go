@@ -0,0 +1,45 @@
+// Package linebuf splits the plain text written to alog's writers into lines.
+package linebuf
+
+import "bytes"
+
+// A Buffer holds back the text written after the last newline until its line
+// is completed. The zero value is an empty Buffer. A Buffer is not safe for
+// concurrent use; the writers that use one hold their own lock around it.
+type Buffer struct {
+	partial []byte
+}
+
+// Add appends p to the buffer and calls line with each line that it
+// completes, without the newline, stopping at the first error. The text
+// passed to line is only valid until the next call.
+func (b *Buffer) Add(p []byte, line func(text []byte) error) error {
+	b.partial = append(b.partial, p...)
+	for {
+		index := bytes.IndexByte(b.partial, '\n')
+		if index == -1 {
+			return nil
+		}
+		text := b.partial[:index]
+		b.partial = b.partial[index+1:]
+		if err := line(text); err != nil {
+			return err
+		}
+	}
+}
+
+// Flush empties the buffer, calling line with the unfinished line if there
+// is one.
+func (b *Buffer) Flush(line func(text []byte) error) error {
+	if len(b.partial) == 0 {
+		return nil
+	}
+	text := b.partial
+	b.partial = nil
+	return line(text)
+}
+
+// Partial returns the unfinished line, if there is one.
+func (b *Buffer) Partial() []byte {
+	return b.partial
+}
@@ -0,0 +1,392 @@
+// Package vt is an in-memory terminal emulator that interprets the subset of
+// control sequences that alog emits. It is used by alogtest and by alog's
+// HTMLWriter.
+package vt
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Style is the set of SGR attributes applied to a Cell.
+type Style struct {
+	Intensity  int // 0 for normal, 1 for bold, 2 for dim
+	Italic     bool
+	Underline  bool
+	Reverse    bool
+	Foreground string // SGR parameters of the foreground color, e.g. "31" or "38;5;208"; empty for the default
+	Background string // SGR parameters of the background color; empty for the default
+}
+
+// Params returns the SGR parameters that select s from the default style,
+// e.g. "1;31", or the empty string for the default style.
+func (s Style) Params() string {
+	var params []string
+	if s.Intensity != 0 {
+		params = append(params, strconv.Itoa(s.Intensity))
+	}
+	if s.Italic {
+		params = append(params, "3")
+	}
+	if s.Underline {
+		params = append(params, "4")
+	}
+	if s.Reverse {
+		params = append(params, "7")
+	}
+	if s.Foreground != "" {
+		params = append(params, s.Foreground)
+	}
+	if s.Background != "" {
+		params = append(params, s.Background)
+	}
+	return strings.Join(params, ";")
+}
+
+// Apply updates s according to the parameters of an SGR escape sequence, e.g.
+// "1;31" for "\033[1;31m".
+func (s *Style) Apply(params string) {
+	if params == "" {
+		params = "0"
+	}
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil {
+			continue
+		}
+		switch {
+		case code == 0:
+			*s = Style{}
+		case code == 1 || code == 2:
+			s.Intensity = code
+		case code == 22:
+			s.Intensity = 0
+		case code == 3:
+			s.Italic = true
+		case code == 23:
+			s.Italic = false
+		case code == 4:
+			s.Underline = true
+		case code == 24:
+			s.Underline = false
+		case code == 7:
+			s.Reverse = true
+		case code == 27:
+			s.Reverse = false
+		case code == 38 || code == 48:
+			// Extended colors: 38;5;n or 38;2;r;g;b
+			n := 0
+			if i+1 < len(codes) && codes[i+1] == "5" {
+				n = 2
+			} else if i+1 < len(codes) && codes[i+1] == "2" {
+				n = 4
+			}
+			if i+n >= len(codes) {
+				n = len(codes) - 1 - i
+			}
+			color := strings.Join(codes[i:i+n+1], ";")
+			if code == 38 {
+				s.Foreground = color
+			} else {
+				s.Background = color
+			}
+			i += n
+		case code == 39:
+			s.Foreground = ""
+		case code == 49:
+			s.Background = ""
+		case (code >= 30 && code <= 37) || (code >= 90 && code <= 97):
+			s.Foreground = codes[i]
+		case (code >= 40 && code <= 47) || (code >= 100 && code <= 107):
+			s.Background = codes[i]
+		}
+	}
+}
+
+// A Cell is a single character position on the screen.
+type Cell struct {
+	Rune  rune
+	Style Style
+}
+
+// Terminal is an in-memory terminal emulator and an io.Writer. It
+// interprets the subset of control sequences that alog emits: carriage returns
+// and newlines, the cursor movements used in multiline mode (as output by
+// `tput cuu` and `tput cud`), erasing, and SGR color sequences. Newlines are
+// treated as a carriage return plus line feed, as a terminal's line discipline
+// would. The screen has no fixed size; lines grow as they are written.
+// A Terminal is safe for concurrent use.
+type Terminal struct {
+	mutex   sync.Mutex
+	rows    [][]Cell
+	row     int
+	col     int
+	style   Style
+	pending []byte
+}
+
+// New returns an empty Terminal with the cursor at the top left.
+func New() *Terminal {
+	return &Terminal{}
+}
+
+func (t *Terminal) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	buf := append(t.pending, p...)
+	t.pending = nil
+	for len(buf) > 0 {
+		n := t.consume(buf)
+		if n == 0 {
+			// Incomplete escape sequence or rune; wait for more input
+			t.pending = append([]byte{}, buf...)
+			break
+		}
+		buf = buf[n:]
+	}
+	return len(p), nil
+}
+
+// consume interprets the control sequence or character at the start of buf,
+// returning the number of bytes used, or 0 if buf ends before it does.
+func (t *Terminal) consume(buf []byte) int {
+	switch c := buf[0]; {
+	case c == '\033':
+		if len(buf) < 2 {
+			return 0
+		}
+		if buf[1] != '[' {
+			// Not a CSI sequence; skip the escape and the next byte
+			return 2
+		}
+		for i := 2; i < len(buf); i++ {
+			if buf[i] >= 0x40 && buf[i] <= 0x7e {
+				t.csi(string(buf[2:i]), buf[i])
+				return i + 1
+			}
+		}
+		return 0
+	case c == '\r':
+		t.col = 0
+	case c == '\n':
+		t.row++
+		t.col = 0
+	case c == '\b':
+		if t.col > 0 {
+			t.col--
+		}
+	case c == '\t':
+		t.col += 8 - t.col%8
+	case c < 0x20 || c == 0x7f:
+		// Ignore other control characters
+	default:
+		if !utf8.FullRune(buf) {
+			return 0
+		}
+		r, size := utf8.DecodeRune(buf)
+		t.put(r)
+		return size
+	}
+	return 1
+}
+
+func (t *Terminal) put(r rune) {
+	for len(t.rows) <= t.row {
+		t.rows = append(t.rows, nil)
+	}
+	row := t.rows[t.row]
+	for len(row) <= t.col {
+		row = append(row, Cell{Rune: ' '})
+	}
+	row[t.col] = Cell{Rune: r, Style: t.style}
+	t.rows[t.row] = row
+	t.col++
+}
+
+func (t *Terminal) csi(params string, final byte) {
+	n, err := strconv.Atoi(params)
+	if err != nil || n < 1 {
+		n = 1
+	}
+	switch final {
+	case 'A':
+		t.row -= n
+		if t.row < 0 {
+			t.row = 0
+		}
+	case 'B':
+		t.row += n
+	case 'C':
+		t.col += n
+	case 'D':
+		t.col -= n
+		if t.col < 0 {
+			t.col = 0
+		}
+	case 'G':
+		t.col = n - 1
+	case 'K':
+		if t.row >= len(t.rows) {
+			return
+		}
+		row := t.rows[t.row]
+		switch params {
+		case "", "0":
+			if t.col < len(row) {
+				t.rows[t.row] = row[:t.col]
+			}
+		case "1":
+			for i := 0; i <= t.col && i < len(row); i++ {
+				row[i] = Cell{Rune: ' '}
+			}
+		case "2":
+			t.rows[t.row] = nil
+		}
+	case 'J':
+		switch params {
+		case "", "0":
+			if t.row < len(t.rows) {
+				if t.col < len(t.rows[t.row]) {
+					t.rows[t.row] = t.rows[t.row][:t.col]
+				}
+				t.rows = t.rows[:t.row+1]
+			}
+		case "2", "3":
+			t.rows = nil
+		}
+	case 'm':
+		t.style.Apply(params)
+	}
+}
+
+// visibleLength returns the length of row without any trailing blanks.
+func visibleLength(row []Cell) int {
+	n := len(row)
+	for n > 0 && row[n-1].Rune == ' ' && row[n-1].Style.Background == "" && !row[n-1].Style.Reverse {
+		n--
+	}
+	return n
+}
+
+// rowsLocked returns the rows of the screen, omitting any trailing empty rows.
+func (t *Terminal) rowsLocked() [][]Cell {
+	n := len(t.rows)
+	for n > 0 && visibleLength(t.rows[n-1]) == 0 {
+		n--
+	}
+	return t.rows[:n]
+}
+
+// Rows returns a copy of the cells of the screen, one slice per line, with
+// trailing blanks and trailing empty lines removed.
+func (t *Terminal) Rows() [][]Cell {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var rows [][]Cell
+	for _, row := range t.rowsLocked() {
+		rows = append(rows, append([]Cell{}, row[:visibleLength(row)]...))
+	}
+	return rows
+}
+
+// Lines returns the text of the screen without colors, one string per line,
+// with trailing blanks and trailing empty lines removed.
+func (t *Terminal) Lines() []string {
+	var lines []string
+	for _, row := range t.Rows() {
+		var sb strings.Builder
+		for _, cell := range row {
+			sb.WriteRune(cell.Rune)
+		}
+		lines = append(lines, sb.String())
+	}
+	return lines
+}
+
+// ColoredLines is like Lines, but includes an SGR escape sequence wherever the
+// style changes, and a reset at the end of any line that ends styled. Each
+// escape selects the complete new style, e.g. "\033[0;1;31m".
+func (t *Terminal) ColoredLines() []string {
+	var lines []string
+	for _, row := range t.Rows() {
+		var sb strings.Builder
+		var style Style
+		for _, cell := range row {
+			if cell.Style != style {
+				sb.WriteString("\033[0")
+				if params := cell.Style.Params(); params != "" {
+					sb.WriteString(";" + params)
+				}
+				sb.WriteString("m")
+				style = cell.Style
+			}
+			sb.WriteRune(cell.Rune)
+		}
+		if style != (Style{}) {
+			sb.WriteString("\033[0m")
+		}
+		lines = append(lines, sb.String())
+	}
+	return lines
+}
+
+// String returns the text of the screen without colors, as lines joined by
+// newlines.
+func (t *Terminal) String() string {
+	return strings.Join(t.Lines(), "\n")
+}
+
+// Cursor returns the current cursor position, counting from zero.
+func (t *Terminal) Cursor() (row int, col int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.row, t.col
+}
+
+// Height returns the number of lines on the screen, not counting trailing
+// empty lines.
+func (t *Terminal) Height() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.rowsLocked())
+}
+
+// PopRows removes the top n lines of the screen, as if they had scrolled out
+// of view, and returns them as Rows would. The cursor moves up along with the
+// rest of the screen, but not past the top.
+func (t *Terminal) PopRows(n int) [][]Cell {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var rows [][]Cell
+	for i := 0; i < n && i < len(t.rows); i++ {
+		row := t.rows[i]
+		rows = append(rows, append([]Cell{}, row[:visibleLength(row)]...))
+	}
+	for len(rows) < n {
+		rows = append(rows, nil)
+	}
+	if n < len(t.rows) {
+		t.rows = append([][]Cell{}, t.rows[n:]...)
+	} else {
+		t.rows = nil
+	}
+	t.row -= n
+	if t.row < 0 {
+		t.row = 0
+	}
+	return rows
+}
+
+// Reset clears the screen and moves the cursor back to the top left.
+func (t *Terminal) Reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rows = nil
+	t.row = 0
+	t.col = 0
+	t.style = Style{}
+	t.pending = nil
+}
@@ -0,0 +1,103 @@
+package alog
+
+// heldLines are the completed lines of a Job's Logger that haven't been
+// written yet.
+type heldLines struct {
+	lines     []*Line  // for a LineWriter output
+	formatted [][]byte // for any other output
+	released  bool
+}
+
+func (h *heldLines) hold(l *Logger, text []byte) {
+	if _, ok := l.out.(LineWriter); ok {
+		h.lines = append(h.lines, l.newLine(text))
+	} else {
+		h.formatted = append(h.formatted, append([]byte{}, l.getFormattedLine(text)...))
+	}
+}
+
+// releaseHeld writes the held lines of l, which must be locked, in one go.
+func (l *Logger) releaseHeld() {
+	if lineWriter, ok := l.out.(LineWriter); ok {
+		for _, line := range l.held.lines {
+			lineWriter.WriteLine(line)
+		}
+	} else {
+		for _, formatted := range l.held.formatted {
+			writeLine(l.out, formatted)
+		}
+		updateTempOutput(l.out)
+	}
+	l.held.lines = nil
+	l.held.formatted = nil
+}
+
+// A Job is a Logger for one of several jobs running in parallel, whose
+// completed lines are held back and then written together as one contiguous
+// block when the job finishes, so that the output of different jobs isn't
+// interleaved. Blocks are written in the order that jobs finish. The job's
+// unfinished line is still shown as a temp line while it runs. Loggers created
+// from the job's Logger, e.g. with Child or RunCommand, hold back their lines
+// in the same block.
+type Job struct {
+	*Logger
+	leaves []*Logger
+}
+
+// Job returns a Job whose Logger is a child of l (see Child) with the given
+// prefix.
+func (l *Logger) Job(prefix string) *Job {
+	child := l.Child(prefix)
+	j := &Job{Logger: child, leaves: child.leafLoggers()}
+	for _, leaf := range j.leaves {
+		ws := getWriterState(leaf.out)
+		ws.lock()
+		leaf.held = &heldLines{}
+		ws.unlock()
+	}
+	return j
+}
+
+// Dump writes the lines held back so far right away, and stops holding back
+// lines, so that the rest of the job's output is written as it happens. Use
+// it when a job fails, to show its output without waiting for it to finish.
+func (j *Job) Dump() {
+	for _, leaf := range j.leaves {
+		ws := getWriterState(leaf.out)
+		ws.lock()
+		leaf.releaseHeld()
+		leaf.held.released = true
+		ws.unlock()
+	}
+}
+
+// Finish completes the job's unfinished line, if it has one, writes the
+// block of lines held back, and closes the job's Logger.
+func (j *Job) Finish() {
+	for _, leaf := range j.leaves {
+		ws := getWriterState(leaf.out)
+		ws.lock()
+		leaf.flushInt()
+		ws.removeTempLogger(leaf)
+		leaf.releaseHeld()
+		leaf.held.released = true
+		leaf.closeInt()
+		ws.unlock()
+	}
+	j.Logger.closeTees()
+}
+
+// closeTees closes l and the Loggers between it and its leaves if l is a tee,
+// leaving the leaves themselves, which Finish has already closed.
+func (l *Logger) closeTees() {
+	ws := getWriterState(l.out)
+	ws.lock()
+	sinks := append([]*Logger{}, l.sinks...)
+	if len(sinks) > 0 {
+		l.closeInt()
+	}
+	ws.unlock()
+	for _, sink := range sinks {
+		sink.closeTees()
+	}
+}
@@ -0,0 +1,254 @@
+package alog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tillberg/alog/internal/linebuf"
+)
+
+// JournalSocket is the path of journald's native protocol socket.
+const JournalSocket = "/run/systemd/journal/socket"
+
+var errJournalWriterClosed = errors.New("Attempted to write to closed JournalWriter.")
+
+// A JournalWriter sends completed lines to systemd-journald over its native
+// protocol, as structured entries with MESSAGE (the text of the line without
+// the prefix, flag header or ANSI escapes), PRIORITY (from the level of the
+// line), CODE_FILE, CODE_LINE and CODE_FUNC (of the code that logged the
+// line), SYSLOG_IDENTIFIER, and any fields added with SetField. Like a
+// SyslogWriter, it is an alog.LineWriter, and plain text written to it is sent
+// a line at a time at LevelInfo.
+//
+// Entries too large for a datagram are written to a temporary in-memory file
+// whose descriptor is passed to journald instead. If sending fails, the
+// JournalWriter reconnects and tries once more.
+//
+// When the program's stderr is connected to the journal (as detected using
+// the JOURNAL_STREAM environment variable that systemd sets), DefaultLogger
+// writes to a JournalWriter instead of to stderr.
+type JournalWriter struct {
+	mutex       sync.Mutex
+	addr        *net.UnixAddr
+	conn        *net.UnixConn
+	fields      []byte // encoded fields added to every entry
+	lines       linebuf.Buffer
+	closed      bool
+	entry       []byte
+	maxDatagram int // entries larger than this are passed as a file; 0 for no limit
+}
+
+// NewJournalWriter returns a JournalWriter that sends to the journald socket
+// at path, or at JournalSocket if path is empty.
+func NewJournalWriter(path string) (*JournalWriter, error) {
+	if path == "" {
+		path = JournalSocket
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	w := &JournalWriter{addr: &net.UnixAddr{Name: path, Net: "unixgram"}}
+	w.fields = appendJournalField(w.fields, "SYSLOG_IDENTIFIER", []byte(filepath.Base(os.Args[0])))
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// stderrJournalWriter returns a JournalWriter to use in place of stderr if
+// stderr is the stream that systemd connected to the journal, or nil
+// otherwise. JOURNAL_STREAM alone isn't enough, as child processes inherit it
+// even when their stderr is redirected elsewhere.
+func stderrJournalWriter(stderr *os.File) *JournalWriter {
+	if !isJournalStream(stderr) {
+		return nil
+	}
+	w, err := NewJournalWriter("")
+	if err != nil {
+		return nil
+	}
+	return w
+}
+
+// wantsCaller returns whether out records the caller of every line, whatever
+// the flags of the Logger.
+func wantsCaller(out io.Writer) bool {
+	_, ok := out.(*JournalWriter)
+	return ok
+}
+
+// connect (re)establishes the connection to journald.
+func (w *JournalWriter) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	// Use an unconnected socket, as the descriptor passing of WriteMsgUnix
+	// needs an address
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// journalFieldName converts key to a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore (which is
+// reserved for fields added by journald).
+func journalFieldName(key string) string {
+	name := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			c -= 'a' - 'A'
+		case (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'):
+		default:
+			c = '_'
+		}
+		if c == '_' && len(name) == 0 {
+			continue
+		}
+		name = append(name, c)
+	}
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		name = append([]byte("F"), name...)
+	}
+	return string(name)
+}
+
+// appendJournalField appends a field in the native protocol's format: NAME=value
+// and a newline, or if value contains a newline, NAME, a newline, the length of
+// value as a little-endian uint64, value and a newline.
+func appendJournalField(buf []byte, name string, value []byte) []byte {
+	buf = append(buf, name...)
+	if bytes.IndexByte(value, '\n') == -1 {
+		buf = append(buf, '=')
+	} else {
+		buf = append(buf, '\n')
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(len(value)))
+	}
+	buf = append(buf, value...)
+	return append(buf, '\n')
+}
+
+// SetField adds a field to every entry sent from now on, replacing any field
+// of the same name. The key is converted to a valid field name, e.g.
+// "request-id" becomes "REQUEST_ID".
+func (w *JournalWriter) SetField(key string, value string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	name := journalFieldName(key)
+	var fields []byte
+	for rest := w.fields; len(rest) > 0; {
+		n := journalFieldLength(rest)
+		if !journalFieldHasName(rest[:n], name) {
+			fields = append(fields, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	w.fields = appendJournalField(fields, name, []byte(value))
+}
+
+// journalFieldLength returns the length of the encoded field at the start of
+// buf.
+func journalFieldLength(buf []byte) int {
+	end := bytes.IndexByte(buf, '\n')
+	if bytes.IndexByte(buf[:end], '=') != -1 {
+		return end + 1
+	}
+	size := int(binary.LittleEndian.Uint64(buf[end+1:]))
+	return end + 1 + 8 + size + 1
+}
+
+func journalFieldHasName(field []byte, name string) bool {
+	return len(field) > len(name) && string(field[:len(name)]) == name && (field[len(name)] == '=' || field[len(name)] == '\n')
+}
+
+// send sends an entry, reconnecting and retrying once on failure.
+func (w *JournalWriter) send() error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil || attempt > 0 {
+			if err = w.connect(); err != nil {
+				continue
+			}
+		}
+		if w.maxDatagram > 0 && len(w.entry) > w.maxDatagram {
+			err = sendJournalFile(w.conn, w.addr, w.entry)
+		} else if _, err = w.conn.WriteToUnix(w.entry, w.addr); isMessageTooLong(err) {
+			err = sendJournalFile(w.conn, w.addr, w.entry)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (w *JournalWriter) sendLocked(line *Line) error {
+	if w.closed {
+		return errJournalWriterClosed
+	}
+	entry := appendJournalField(w.entry[:0], "MESSAGE", Uncolorize(line.Message))
+	entry = appendJournalField(entry, "PRIORITY", strconv.AppendInt(nil, int64(syslogSeverity(line.Level)), 10))
+	if line.CallerFile != "" {
+		// Set for every line from a Logger; see wantsCaller
+		entry = appendJournalField(entry, "CODE_FILE", []byte(line.CallerFile))
+		entry = appendJournalField(entry, "CODE_LINE", strconv.AppendInt(nil, int64(line.CallerLine), 10))
+		entry = appendJournalField(entry, "CODE_FUNC", []byte(line.CallerFunc))
+	}
+	for _, field := range line.Fields {
+		entry = appendJournalField(entry, journalFieldName(field.Key), []byte(fmt.Sprint(field.Value)))
+	}
+	w.entry = append(entry, w.fields...)
+	return w.send()
+}
+
+// WriteLine implements LineWriter.
+func (w *JournalWriter) WriteLine(line *Line) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.sendLocked(line)
+}
+
+// Write implements io.Writer.
+func (w *JournalWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(p), w.lines.Add(p, w.sendText)
+}
+
+// sendText sends a line of plain text written to w at LevelInfo.
+func (w *JournalWriter) sendText(text []byte) error {
+	return w.sendLocked(&Line{Time: time.Now(), Message: text})
+}
+
+// Close sends any unfinished line written with Write and closes the
+// connection.
+func (w *JournalWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	err := w.lines.Flush(w.sendText)
+	w.closed = true
+	if w.conn != nil {
+		if closeErr := w.conn.Close(); err == nil {
+			err = closeErr
+		}
+		w.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package alog
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// isJournalStream returns whether f is the stream that systemd connected to
+// the journal, as identified by the device and inode numbers in the
+// JOURNAL_STREAM environment variable.
+func isJournalStream(f *os.File) bool {
+	parts := strings.SplitN(os.Getenv("JOURNAL_STREAM"), ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	dev, err1 := strconv.ParseUint(parts[0], 10, 64)
+	ino, err2 := strconv.ParseUint(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &stat); err != nil {
+		return false
+	}
+	return uint64(stat.Dev) == dev && uint64(stat.Ino) == ino
+}
+
+// sendJournalFile passes entry to journald as a file descriptor, for entries
+// too large to send as a datagram. Like sd_journal_send, it uses a sealed
+// memfd, or on kernels without memfd, an unlinked file in /dev/shm.
+func sendJournalFile(conn *net.UnixConn, addr *net.UnixAddr, entry []byte) error {
+	f, err := journalMemfd(entry)
+	if err != nil {
+		f, err = journalTempFile(entry)
+		if err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+	_, _, err = conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), addr)
+	return err
+}
+
+// journalMemfd returns a memfd holding entry, sealed so that journald knows
+// that it can't change.
+func journalMemfd(entry []byte) (*os.File, error) {
+	fd, err := unix.MemfdCreate("alog-journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "alog-journal")
+	if _, err := f.Write(entry); err != nil {
+		f.Close()
+		return nil, err
+	}
+	seals := unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, seals); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// journalTempFile returns an unlinked temporary file holding entry.
+func journalTempFile(entry []byte) (*os.File, error) {
+	f, err := os.CreateTemp("/dev/shm", "alog-journal-")
+	if err != nil {
+		f, err = os.CreateTemp("", "alog-journal-")
+		if err != nil {
+			return nil, err
+		}
+	}
+	os.Remove(f.Name())
+	if _, err := f.Write(entry); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)
+}
@@ -0,0 +1,102 @@
+package alog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalWriter(t *testing.T) {
+	assert := assert.New(t)
+	socketPath := filepath.Join(t.TempDir(), "socket")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if !assert.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	journal, err := NewJournalWriter(socketPath)
+	if !assert.NoError(err) {
+		return
+	}
+	defer journal.Close()
+	journal.SetField("request-id", "abc")
+	journal.SetField("REQUEST_ID", "123")
+	var writer = New(journal, "[prefix] ", Lshortfile|Lfunc)
+	writer.Error("\033[31mfailed\033[0m")
+	packet := make([]byte, 4096)
+	oob := make([]byte, 1024)
+	n, _, _, _, err := listener.ReadMsgUnix(packet, oob)
+	assert.NoError(err)
+	entry := string(packet[:n])
+	assert.Contains(entry, "MESSAGE=failed\n")
+	assert.NotContains(entry, "prefix")
+	assert.Contains(entry, "PRIORITY=3\n")
+	assert.Contains(entry, "CODE_FILE=journal_linux_test.go\n")
+	assert.Contains(entry, "CODE_FUNC=alog.TestJournalWriter\n")
+	assert.Contains(entry, "SYSLOG_IDENTIFIER=")
+	assert.Contains(entry, "REQUEST_ID=123\n")
+	assert.NotContains(entry, "abc")
+
+	// The caller is sent even without the caller flags
+	New(journal, "", 0).Info("no flags")
+	n, _, _, _, err = listener.ReadMsgUnix(packet, oob)
+	assert.NoError(err)
+	assert.Contains(string(packet[:n]), "MESSAGE=no flags\n")
+	assert.Contains(string(packet[:n]), "CODE_FILE=")
+	assert.Contains(string(packet[:n]), "/journal_linux_test.go\n")
+	assert.Contains(string(packet[:n]), "CODE_FUNC=alog.TestJournalWriter\n")
+
+	// Values containing newlines are length-prefixed
+	journal.SetField("multi", "a\nb")
+	journal.Write([]byte("plain\n"))
+	n, _, _, _, err = listener.ReadMsgUnix(packet, oob)
+	assert.NoError(err)
+	assert.Contains(string(packet[:n]), "MULTI\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n")
+	assert.Contains(string(packet[:n]), "PRIORITY=6\n")
+
+	// Large entries are passed as a file descriptor
+	journal.maxDatagram = 64
+	writer.Log("large")
+	n, oobn, _, _, err := listener.ReadMsgUnix(packet, oob)
+	assert.NoError(err)
+	assert.Equal(0, n)
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if !assert.NoError(err) || !assert.Len(messages, 1) {
+		return
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if !assert.NoError(err) || !assert.Len(fds, 1) {
+		return
+	}
+	f := os.NewFile(uintptr(fds[0]), "entry")
+	defer f.Close()
+	f.Seek(0, io.SeekStart)
+	contents, err := io.ReadAll(f)
+	assert.NoError(err)
+	assert.Contains(string(contents), "MESSAGE=large\n")
+}
+
+func TestStderrJournalWriter(t *testing.T) {
+	assert := assert.New(t)
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer stderr.Close()
+	var stat syscall.Stat_t
+	if !assert.NoError(syscall.Fstat(int(stderr.Fd()), &stat)) {
+		return
+	}
+	// An inherited JOURNAL_STREAM doesn't describe a redirected stderr
+	t.Setenv("JOURNAL_STREAM", "1:2")
+	assert.False(isJournalStream(stderr))
+	assert.Nil(stderrJournalWriter(stderr))
+	t.Setenv("JOURNAL_STREAM", fmt.Sprintf("%d:%d", stat.Dev, stat.Ino))
+	assert.True(isJournalStream(stderr))
+}
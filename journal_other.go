@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package alog
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// journald only runs on Linux.
+
+func isJournalStream(f *os.File) bool {
+	return false
+}
+
+func sendJournalFile(conn *net.UnixConn, addr *net.UnixAddr, entry []byte) error {
+	return errors.New("Passing files to journald is not supported on this platform.")
+}
+
+func isMessageTooLong(err error) bool {
+	return false
+}
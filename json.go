@@ -0,0 +1,79 @@
+package alog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tillberg/alog/internal/linebuf"
+)
+
+// A JSONLine is the form in which a JSONWriter, or a NetworkWriter with the
+// JSON option, writes each Line, one object per line of output. Colors are
+// removed.
+type JSONLine struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Prefix  string            `json:"prefix,omitempty"`
+	Message string            `json:"message"`
+	File    string            `json:"file,omitempty"`
+	Line    int               `json:"line,omitempty"`
+	Func    string            `json:"func,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// encodeJSONLine returns line as a JSONLine object followed by a newline.
+func encodeJSONLine(line *Line) []byte {
+	var fields map[string]string
+	for _, field := range line.Fields {
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		fields[field.Key] = fmt.Sprint(field.Value)
+	}
+	buf, _ := json.Marshal(JSONLine{
+		Time:    line.Time,
+		Level:   line.Level.String(),
+		Prefix:  string(Uncolorize(line.Prefix)),
+		Message: string(Uncolorize(line.Message)),
+		File:    line.CallerFile,
+		Line:    line.CallerLine,
+		Func:    line.CallerFunc,
+		Fields:  fields,
+	})
+	return append(buf, '\n')
+}
+
+// A JSONWriter is a LineWriter that writes each completed line to an
+// io.Writer as a JSONLine object on a line of its own. Plain text written to
+// it is written a line at a time at LevelInfo.
+type JSONWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+	lines linebuf.Buffer
+}
+
+// NewJSONWriter returns a JSONWriter that writes to out.
+func NewJSONWriter(out io.Writer) *JSONWriter {
+	return &JSONWriter{out: out}
+}
+
+// WriteLine implements LineWriter.
+func (w *JSONWriter) WriteLine(line *Line) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := w.out.Write(encodeJSONLine(line))
+	return err
+}
+
+// Write implements io.Writer.
+func (w *JSONWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(p), w.lines.Add(p, func(text []byte) error {
+		_, err := w.out.Write(encodeJSONLine(&Line{Time: time.Now(), Message: text}))
+		return err
+	})
+}
@@ -0,0 +1,161 @@
+package alog
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// ParseLevel returns the Level named by s ("debug", "info", "warn" or
+// "warning", or "error"), ignoring case.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %q.", s)
+}
+
+// normalizeLevelName converts a logger name to the form used to look up its
+// level: upper case letters and digits, with anything else replaced by
+// underscores, so that "http/client" matches ALOG_LEVEL_HTTP_CLIENT.
+func normalizeLevelName(name string) string {
+	key := make([]byte, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			c -= 'a' - 'A'
+		case (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'):
+		default:
+			c = '_'
+		}
+		key[i] = c
+	}
+	return string(key)
+}
+
+// filters returns the filter of l, if it has one, and the global filter, in
+// order of precedence.
+func (l *Logger) filters() [2]*levelFilter {
+	return [2]*levelFilter{l.filter, activeFilter.Load()}
+}
+
+// getLevel returns the level threshold of l: the level set for its name by
+// the filters, or else its own level.
+func (l *Logger) getLevel() Level {
+	filters := l.filters()
+	for _, f := range filters {
+		if level, ok := f.levelForName(l.name); ok {
+			return level
+		}
+	}
+	return l.ownLevel(filters)
+}
+
+// ownLevel returns the level of l, or the filters' default level, or that of
+// DefaultLogger, or LevelInfo.
+func (l *Logger) ownLevel(filters [2]*levelFilter) Level {
+	if l.level != nil {
+		return *l.level
+	}
+	for _, f := range filters {
+		if f != nil && f.level != nil {
+			return *f.level
+		}
+	}
+	if DefaultLogger.level != nil {
+		return *DefaultLogger.level
+	}
+	return LevelInfo
+}
+
+// enabled returns whether output at level is shown, for output from the frame
+// that runtime.Caller(calldepth) would report within enabled, i.e. calldepth
+// is the same as for intOutput. That frame is only looked up if the filters
+// have no level for the name of l but might have one for the frame's package.
+func (l *Logger) enabled(calldepth int, level Level) bool {
+	filters := l.filters()
+	if filters[0].hasLevels() || filters[1].hasLevels() {
+		for _, f := range filters {
+			if threshold, ok := f.levelForName(l.name); ok {
+				return level >= threshold
+			}
+		}
+		var pcs [1]uintptr
+		// +1 to skip runtime.Callers
+		if runtime.Callers(calldepth+l.callerSkip+1, pcs[:]) > 0 {
+			for _, f := range filters {
+				if f.hasLevels() {
+					if threshold, ok := f.levelForPC(pcs[0]); ok {
+						return level >= threshold
+					}
+				}
+			}
+		}
+	}
+	return level >= l.ownLevel(filters)
+}
+
+// startLevel sets the level of the current line to level if nothing has been
+// written to it yet, or else raises it.
+func (l *Logger) startLevel(level Level) {
+	if level < l.lineLevel && !l.hasPartialLine() {
+		l.lineLevel = level
+		return
+	}
+	l.raiseLevel(level)
+}
+
+// Level returns the level threshold of the logger: output below it is
+// discarded.
+func (l *Logger) Level() Level {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	return l.getLevel()
+}
+
+// SetLevel sets the level threshold of the logger. Logging functions called
+// below it return without formatting anything. Loggers without a level of
+// their own use that of DefaultLogger, which defaults to LevelInfo.
+func (l *Logger) SetLevel(level Level) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.level = &level
+}
+
+// Name returns the name of the logger, or "" if it has none.
+func (l *Logger) Name() string {
+	return l.name
+}
+
+// Named returns a new Logger like Child(""), named name, or for a child of a
+// named Logger, "<parent name>/name". Its level threshold can be configured
+// by name; see SetFilter and SetLevelForName.
+func (l *Logger) Named(name string) *Logger {
+	c := l.Child("")
+	if l.name != "" {
+		name = l.name + "/" + name
+	}
+	c.setName(name)
+	return c
+}
+
+func (l *Logger) setName(name string) {
+	l.name = name
+	l.eachSink(func(sink *Logger) { sink.name = name })
+}
+
+// SetLevel sets the level threshold of the standard logger, which is also
+// used by Loggers that don't have one of their own.
+func SetLevel(level Level) {
+	DefaultLogger.SetLevel(level)
+}
@@ -0,0 +1,374 @@
+package alog
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long the suppressed repeats of a line are counted before they are
+// reported, if no other line is written first.
+const repeatedNoticeDelay = time.Second
+
+// lineLimits holds a Logger's settings and state for suppressing floods of
+// lines. It is shared between a Logger and the copies made by WithCallerSkip,
+// so that they are limited together.
+type lineLimits struct {
+	mutex            sync.Mutex
+	now              func() time.Time // time.Now, except in tests
+	collapse         bool
+	lastLine         []byte
+	lastLevel        Level
+	repeats          int
+	repeatDelay      time.Duration
+	repeatTimer      *time.Timer // writes the notice for repeats after repeatDelay
+	rate             float64     // tokens per second; 0 for no rate limit
+	burst            float64
+	sampleFirst      int
+	sampleThereafter int
+	sites            map[uintptr]*siteState
+	callSites        map[uintptr]*callSiteState
+}
+
+// siteState tracks the rate limit and sampling of the lines logged from one
+// call site.
+type siteState struct {
+	tokens     float64
+	refilled   time.Time
+	suppressed int
+	count      int
+}
+
+// callSiteState tracks the calls to Once, EveryN or Every from one call site.
+type callSiteState struct {
+	calls   int
+	written int
+	last    time.Time // when a line was last written
+}
+
+func newLineLimits() *lineLimits {
+	return &lineLimits{now: time.Now, repeatDelay: repeatedNoticeDelay}
+}
+
+// clone returns lineLimits with the same settings as ll but none of its
+// state, for a Logger whose lines are limited separately from ll's.
+func (ll *lineLimits) clone() *lineLimits {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	return &lineLimits{
+		now:              ll.now,
+		collapse:         ll.collapse,
+		repeatDelay:      ll.repeatDelay,
+		rate:             ll.rate,
+		burst:            ll.burst,
+		sampleFirst:      ll.sampleFirst,
+		sampleThereafter: ll.sampleThereafter,
+	}
+}
+
+// needsCallSite returns whether lines must be attributed to a call site in
+// order to be rate limited or sampled.
+func (ll *lineLimits) needsCallSite() bool {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	return ll.rate > 0 || ll.sampleFirst > 0 || ll.sampleThereafter > 0
+}
+
+// site returns the state of the call site at pc, creating it if necessary.
+func (ll *lineLimits) site(pc uintptr, now time.Time) *siteState {
+	if ll.sites == nil {
+		ll.sites = map[uintptr]*siteState{}
+	}
+	site, ok := ll.sites[pc]
+	if !ok {
+		site = &siteState{tokens: ll.burst, refilled: now}
+		ll.sites[pc] = site
+	}
+	return site
+}
+
+// filter decides whether line, logged at level from the call site at pc,
+// should be written. It also returns any notices about earlier lines that
+// were suppressed, which should be written first.
+func (ll *lineLimits) filter(pc uintptr, level Level, line []byte) (notices []string, allow bool) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	now := ll.now()
+	if ll.sampleFirst > 0 || ll.sampleThereafter > 0 {
+		site := ll.site(pc, now)
+		n := site.count
+		site.count++
+		if n >= ll.sampleFirst && (ll.sampleThereafter <= 0 || (n-ll.sampleFirst+1)%ll.sampleThereafter != 0) {
+			return nil, false
+		}
+	}
+	if ll.rate > 0 {
+		site := ll.site(pc, now)
+		site.tokens += now.Sub(site.refilled).Seconds() * ll.rate
+		if site.tokens > ll.burst {
+			site.tokens = ll.burst
+		}
+		site.refilled = now
+		if site.tokens < 1 {
+			site.suppressed++
+			return nil, false
+		}
+		site.tokens--
+		if site.suppressed > 0 {
+			notices = append(notices, plural(site.suppressed, "line")+" suppressed by rate limit")
+			site.suppressed = 0
+		}
+	}
+	if ll.collapse {
+		if ll.lastLine != nil && level == ll.lastLevel && bytes.Equal(line, ll.lastLine) {
+			ll.repeats++
+			return notices, false
+		}
+		if notice := ll.takeRepeated(); notice != "" {
+			notices = append([]string{notice}, notices...)
+		}
+		ll.lastLine = append(ll.lastLine[:0], line...)
+		ll.lastLevel = level
+	}
+	return notices, true
+}
+
+// takeRepeated returns the notice for any repeats of the last line that have
+// been suppressed, and resets the count.
+func (ll *lineLimits) takeRepeated() string {
+	if ll.repeatTimer != nil {
+		ll.repeatTimer.Stop()
+		ll.repeatTimer = nil
+	}
+	if ll.repeats == 0 {
+		return ""
+	}
+	notice := "last message repeated " + plural(ll.repeats, "time")
+	ll.repeats = 0
+	return notice
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return strconv.Itoa(n) + " " + noun + "s"
+}
+
+// completeLine writes a completed line of text, unless the Logger's limits
+// suppress it.
+func (l *Logger) completeLine(text []byte) {
+	l.helper()()
+	notices, allow := l.limits.filter(l.callerPC, l.lineLevel, text)
+	for _, notice := range notices {
+		l.outputNotice(notice, LevelInfo)
+	}
+	if !allow {
+		l.scheduleRepeated()
+	} else {
+		if _, ok := l.out.(LineWriter); !ok {
+			text = appendFields(text, l.getTheme(), l.lineFields)
+		}
+		l.outputLine(text)
+	}
+}
+
+// outputLine writes a completed line of text to the Logger's output.
+func (l *Logger) outputLine(text []byte) {
+	l.helper()()
+	if l.held != nil && !l.held.released {
+		l.held.hold(l, text)
+	} else if lineWriter, ok := l.out.(LineWriter); ok {
+		lineWriter.WriteLine(l.newLine(text))
+	} else {
+		writeLine(l.out, l.getFormattedLine(text))
+	}
+}
+
+// outputNotice writes a dimmed line about suppressed lines.
+func (l *Logger) outputNotice(notice string, level Level) {
+	l.helper()()
+	lineLevel, lineFields := l.lineLevel, l.lineFields
+	l.lineLevel, l.lineFields = level, nil
+	l.outputLine(colorize(nil, l.getTheme(), "muted", notice))
+	l.lineLevel, l.lineFields = lineLevel, lineFields
+}
+
+// scheduleRepeated arranges for the notice for any suppressed repeats of the
+// last line to be written once repeatDelay has passed, unless it is written
+// before then, so that it doesn't wait for the next line.
+func (l *Logger) scheduleRepeated() {
+	ll := l.limits
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	if ll.repeats == 0 || ll.repeatTimer != nil {
+		return
+	}
+	ll.repeatTimer = time.AfterFunc(ll.repeatDelay, func() {
+		ws := getWriterState(l.out)
+		ws.lock()
+		defer ws.unlock()
+		if !l.isClosed {
+			l.flushRepeated()
+		}
+	})
+}
+
+// flushRepeated writes the notice for any suppressed repeats of the last line,
+// so that they are accounted for before the Logger is flushed or closed.
+func (l *Logger) flushRepeated() {
+	l.limits.mutex.Lock()
+	notice := l.limits.takeRepeated()
+	level := l.limits.lastLevel
+	l.limits.mutex.Unlock()
+	if notice == "" {
+		return
+	}
+	l.now = l.limits.now()
+	if l.flag&LUTC != 0 {
+		l.now = l.now.UTC()
+	}
+	l.outputNotice(notice, level)
+	if _, ok := l.out.(LineWriter); !ok {
+		updateTempOutput(l.out)
+	}
+}
+
+// SetCollapseRepeated sets whether identical consecutive lines are collapsed.
+// Only the first is written; the rest are counted and reported with a "last
+// message repeated N times" line once a different line is written, the Logger
+// is flushed, or a second has passed since the first repeat. Lines are
+// compared without their prefix, so lines that differ only in their
+// timestamps are still collapsed.
+func (l *Logger) SetCollapseRepeated(flag bool) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	if !flag {
+		l.flushRepeated()
+	}
+	l.limits.mutex.Lock()
+	defer l.limits.mutex.Unlock()
+	l.limits.collapse = flag
+	l.limits.lastLine = nil
+}
+
+// SetRateLimit limits the lines written from each call site to perSecond on
+// average, with bursts of up to burst lines, using a token bucket. Once lines
+// from a call site are allowed again, a line reports how many were
+// suppressed. A rate of 0 removes the limit.
+func (l *Logger) SetRateLimit(perSecond float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.limits.mutex.Lock()
+	defer l.limits.mutex.Unlock()
+	l.limits.rate = perSecond
+	l.limits.burst = float64(burst)
+	l.limits.sites = nil
+}
+
+// SetSampling makes the Logger write only the first lines from each call
+// site, and after that only every thereafter'th line. If thereafter is 0, no
+// further lines are written. Sampled out lines are dropped silently. Passing
+// 0 for both turns sampling off.
+func (l *Logger) SetSampling(first int, thereafter int) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.limits.mutex.Lock()
+	defer l.limits.mutex.Unlock()
+	l.limits.sampleFirst = first
+	l.limits.sampleThereafter = thereafter
+	l.limits.sites = nil
+}
+
+// logAtCallSite writes a line like Log if allow returns true for the state of
+// the call site of the exported function that called it.
+func (l *Logger) logAtCallSite(allow func(site *callSiteState, now time.Time) bool, format string, v ...interface{}) {
+	l.helper()()
+	var pcs [1]uintptr
+	// Skip runtime.Callers, logAtCallSite and Once, EveryN or Every
+	runtime.Callers(3+l.callerSkip, pcs[:])
+	l.limits.mutex.Lock()
+	now := l.limits.now()
+	if l.limits.callSites == nil {
+		l.limits.callSites = map[uintptr]*callSiteState{}
+	}
+	site, ok := l.limits.callSites[pcs[0]]
+	if !ok {
+		site = &callSiteState{}
+		l.limits.callSites[pcs[0]] = site
+	}
+	ok = allow(site, now)
+	site.calls++
+	if ok {
+		site.written++
+		site.last = now
+	}
+	l.limits.mutex.Unlock()
+	if ok {
+		l.printf(4, LevelInfo, format+"\n", v...)
+	}
+}
+
+func allowOnce(site *callSiteState, now time.Time) bool {
+	return site.written == 0
+}
+
+func allowEveryN(n int) func(*callSiteState, time.Time) bool {
+	return func(site *callSiteState, now time.Time) bool {
+		return n <= 1 || site.calls%n == 0
+	}
+}
+
+func allowEvery(d time.Duration) func(*callSiteState, time.Time) bool {
+	return func(site *callSiteState, now time.Time) bool {
+		return site.written == 0 || now.Sub(site.last) >= d
+	}
+}
+
+// Once writes a line like Log the first time it is called from a given call
+// site, and does nothing after that.
+func (l *Logger) Once(format string, v ...interface{}) {
+	l.helper()()
+	l.logAtCallSite(allowOnce, format, v...)
+}
+
+// EveryN writes a line like Log on the first and then every nth call from a
+// given call site.
+func (l *Logger) EveryN(n int, format string, v ...interface{}) {
+	l.helper()()
+	l.logAtCallSite(allowEveryN(n), format, v...)
+}
+
+// Every writes a line like Log if it has not written one from the same call
+// site within the last d.
+func (l *Logger) Every(d time.Duration, format string, v ...interface{}) {
+	l.helper()()
+	l.logAtCallSite(allowEvery(d), format, v...)
+}
+
+func SetCollapseRepeated(flag bool)             { DefaultLogger.SetCollapseRepeated(flag) }
+func SetRateLimit(perSecond float64, burst int) { DefaultLogger.SetRateLimit(perSecond, burst) }
+func SetSampling(first int, thereafter int)     { DefaultLogger.SetSampling(first, thereafter) }
+
+func Once(format string, v ...interface{}) {
+	DefaultLogger.helper()()
+	DefaultLogger.logAtCallSite(allowOnce, format, v...)
+}
+
+func EveryN(n int, format string, v ...interface{}) {
+	DefaultLogger.helper()()
+	DefaultLogger.logAtCallSite(allowEveryN(n), format, v...)
+}
+
+func Every(d time.Duration, format string, v ...interface{}) {
+	DefaultLogger.helper()()
+	DefaultLogger.logAtCallSite(allowEvery(d), format, v...)
+}
@@ -0,0 +1,145 @@
+package alog
+
+import (
+	"io"
+	"strconv"
+	"time"
+)
+
+// Level is the severity of a line of output.
+type Level int
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(level)) + ")"
+}
+
+// raiseLevel raises the level of the current line to level, if it is higher.
+// The level of a line is the highest level of anything written to it, and
+// goes back to LevelInfo once the line is completed.
+func (l *Logger) raiseLevel(level Level) {
+	if level > l.lineLevel {
+		l.lineLevel = level
+	}
+}
+
+// A Line is a completed line of output, along with its metadata.
+type Line struct {
+	Time       time.Time
+	Level      Level
+	Prefix     []byte // the formatted prefix and flag header
+	Message    []byte // the text of the line, without its trailing newline
+	CallerFile string // only set if the Logger has one of the caller flags
+	CallerLine int
+	CallerFunc string
+	Fields     []Field // added by the context-aware logging functions
+	theme      string  // of the Logger, for the colors of Fields
+}
+
+// Bytes returns the line as it would be written to a terminal, without its
+// trailing newline.
+func (line *Line) Bytes() []byte {
+	return appendFields(append(append([]byte{}, line.Prefix...), line.Message...), line.theme, line.Fields)
+}
+
+// A LineWriter receives completed lines along with their metadata, in place of
+// the stream of text and terminal escapes that a Logger would otherwise write.
+// Partial lines are never drawn as temp lines on a LineWriter. Any colors in a
+// Line have already been removed if color is disabled for the Logger.
+// WriteLine is called with the writer's lock held, so it must not write to
+// Loggers that share the same output.
+type LineWriter interface {
+	WriteLine(line *Line) error
+}
+
+// newLine returns the Line for text completed by l.
+func (l *Logger) newLine(text []byte) *Line {
+	line := &Line{
+		Time:       l.now,
+		Level:      l.lineLevel,
+		CallerFile: l.callerFile,
+		CallerLine: l.callerLine,
+		CallerFunc: l.callerFunc,
+		theme:      l.getTheme(),
+	}
+	if len(l.lineFields) > 0 {
+		line.Fields = append([]Field{}, l.lineFields...)
+	}
+	l.tmp = l.tmp[:0]
+	l.formatHeader(&l.tmp)
+	l.tmp = append(l.tmp, getActiveAnsiCodes(l.tmp).getResetBytes()...)
+	line.Prefix = append([]byte{}, l.tmp...)
+	line.Message = append([]byte{}, text...)
+	if !l.isColorEnabled() {
+		line.Prefix = Uncolorize(line.Prefix)
+		line.Message = Uncolorize(line.Message)
+	}
+	return line
+}
+
+// PartialLine returns the text written to the logger since its last completed
+// line, i.e. what it is currently showing as a temp line.
+func (l *Logger) PartialLine() string {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	return string(l.buf)
+}
+
+// Writer returns the output destination for the logger.
+func (l *Logger) Writer() io.Writer {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	return l.out
+}
+
+// Writer returns the output destination for the standard logger.
+func Writer() io.Writer {
+	return DefaultLogger.Writer()
+}
+
+// A testHelper is an output that reports lines to a test, such as alogtest's
+// TestWriter. Each logging function calls the function it returns (normally
+// the test's Helper method) so that the test attributes lines to the code that
+// logged them rather than to alog.
+type testHelper interface {
+	HelperFunc() func()
+}
+
+func noHelper() {}
+
+// helper returns the function that logging functions call to mark themselves
+// as test helpers.
+func (l *Logger) helper() func() {
+	if l.helperFunc == nil {
+		return noHelper
+	}
+	return l.helperFunc
+}
+
+// setOut sets the output of l, looking up its helper function once rather
+// than on every call.
+func (l *Logger) setOut(out io.Writer) {
+	l.out = out
+	l.helperFunc = noHelper
+	if h, ok := out.(testHelper); ok {
+		l.helperFunc = h.HelperFunc()
+	}
+}
@@ -28,8 +28,6 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
-	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -55,6 +53,8 @@ const (
 	LUTC                      // if Ldate or Ltime is set, use UTC rather than the local time zone
 	Lelapsed                  // elapsed time since this line was first started
 	Lisodate
+	Lfunc                     // name of the calling function: pkg.(*Type).Method
+	Lrelfile                  // file name relative to the main module root: a/b/d.go:23. overrides Lshortfile
 	LstdFlags = Ldate | Ltime // initial values for the standard logger
 )
 
@@ -99,6 +99,8 @@ func (code ColorCode) GetAnsiCodes() []int {
 	return codes
 }
 
+// The color template codes other than those defined by themes; see Theme.
+var ansiColorCodesMutex sync.RWMutex
 var ansiColorCodes = map[string]ColorCode{
 	"r":       ColorResetAll,
 	"reset":   ColorResetAll,
@@ -115,10 +117,6 @@ var ansiColorCodes = map[string]ColorCode{
 	"cyan":    ColorCyan,
 	"white":   ColorWhite,
 	"cr":      ColorReset,
-
-	"error":   ColorRed,
-	"success": ColorGreen,
-	"warn":    ColorYellow,
 }
 
 var tputCache = make(map[string]string)
@@ -172,20 +170,34 @@ func (w *WriterState) addTempLogger(l *Logger) {
 	w.tempLoggers = append(w.tempLoggers, l)
 }
 
+// flushAll and closeAll iterate over a copy of tempLoggers, as flushing a
+// Logger removes it from the list.
 func (w *WriterState) flushAll() {
-	for _, logger := range w.tempLoggers {
+	for _, logger := range append([]*Logger{}, w.tempLoggers...) {
 		logger.flushInt()
 	}
 }
 
 func (w *WriterState) closeAll() {
-	for _, logger := range w.tempLoggers {
+	for _, logger := range append([]*Logger{}, w.tempLoggers...) {
 		logger.flushInt()
 		logger.closeInt()
 	}
 }
 
+func newWriterState() *WriterState {
+	ws := &WriterState{}
+	ws.cursorIsAtBegin = true
+	ws.cursorIsInline = false
+	ws.lastTemp = [][]byte{[]byte{}}
+	return ws
+}
+
 func getWriterState(writer io.Writer) *WriterState {
+	if t, ok := writer.(*teeOutput); ok {
+		// Tees keep their own, so that they don't accumulate in writers
+		return t.ws
+	}
 	mutexGlobal.RLock()
 	ws, ok := writers[writer]
 	mutexGlobal.RUnlock()
@@ -193,10 +205,7 @@ func getWriterState(writer io.Writer) *WriterState {
 		mutexGlobal.Lock()
 		ws, ok = writers[writer]
 		if !ok {
-			ws = &WriterState{}
-			ws.cursorIsAtBegin = true
-			ws.cursorIsInline = false
-			ws.lastTemp = [][]byte{[]byte{}}
+			ws = newWriterState()
 			writers[writer] = ws
 		}
 		mutexGlobal.Unlock()
@@ -220,8 +229,6 @@ var bytesNewline = []byte{byteNewline}
 var bytesSpace = []byte(" ")
 
 var bytesComma = []byte(",")
-var ansiColorRegexp = regexp.MustCompile("\033\\[(\\d+(?:;\\d+)*)m")
-var ansiColorOrCharRegexp = regexp.MustCompile("(\033\\[\\d+m)|.")
 var ansiBytesEscapeStart = []byte("\033[")
 var ansiBytesColorEscapeEnd = []byte("m")
 var ansiBytesResetAll = []byte("\033[0m")
@@ -279,9 +286,17 @@ func (codes *ActiveAnsiCodes) getResetBytes() []byte {
 
 func getActiveAnsiCodes(buf []byte) *ActiveAnsiCodes {
 	var ansiActive ActiveAnsiCodes
-	for _, groups := range ansiColorRegexp.FindAllSubmatch(buf, -1) {
-		code, _ := strconv.ParseInt(string(groups[1]), 10, 32)
-		ansiActive.add(int(code))
+	for i := 0; i < len(buf); {
+		index, length, code, multiple := nextAnsiEscape(buf, i)
+		if length == 0 {
+			break
+		}
+		if multiple {
+			// Escapes with several codes are treated as a reset
+			code = 0
+		}
+		ansiActive.add(code)
+		i = index + length
 	}
 	return &ansiActive
 }
@@ -291,25 +306,41 @@ func getActiveAnsiCodes(buf []byte) *ActiveAnsiCodes {
 // the Writer's Write method.  A Logger can be used simultaneously from
 // multiple goroutines; it guarantees to serialize access to the Writer.
 type Logger struct {
-	prefix               []byte    // prefix to write at beginning of each line
-	flag                 int       // properties
-	out                  io.Writer // destination for output
-	buf                  []byte    // for accumulating text to write
-	tmp                  []byte    // for formatting the current line
-	prefixFormatted      []byte
-	cursorByteIndex      int
-	tempLineActive       bool
-	isClosed             bool
-	partialLinesEnabled  *bool
-	colorEnabled         *bool
-	colorTemplateEnabled *bool
-	autoAppendNewline    *bool
-	colorRegexp          *regexp.Regexp
-	termWidth            int
-	callerFile           string
-	callerLine           int
-	now                  time.Time
-	lineStartTime        time.Time
+	prefix                  []byte    // prefix to write at beginning of each line
+	flag                    int       // properties
+	out                     io.Writer // destination for output
+	helperFunc              func()    // see helper; resolved when out is set
+	buf                     []byte    // for accumulating text to write
+	tmp                     []byte    // for formatting the current line
+	prefixFormatted         []byte
+	cursorByteIndex         int
+	tempLineActive          bool
+	isClosed                bool
+	partialLinesEnabled     *bool
+	colorEnabled            *bool
+	colorTemplateEnabled    *bool
+	autoAppendNewline       *bool
+	colorRegexp             *regexp.Regexp
+	termWidth               int
+	callerFile              string
+	callerLine              int
+	callerFunc              string
+	callerPC                uintptr
+	callerSkip              int
+	lineLevel               Level
+	lineFields              []Field
+	lineDone                chan struct{} // closed when the line is completed, if its context is watched
+	sinks                   []*Logger
+	limits                  *lineLimits
+	name                    string
+	level                   *Level
+	filter                  *levelFilter // set by Config.Apply; consulted before the global filter
+	held                    *heldLines   // completed lines held back by a Job, shared with its descendants
+	theme                   string       // the name of a registered Theme
+	stackTraceDepth         int
+	stackTraceAllGoroutines *bool
+	now                     time.Time
+	lineStartTime           time.Time
 }
 
 type LoggerInt interface {
@@ -360,22 +391,56 @@ type LoggerInt interface {
 // The prefix appears at the beginning of each generated log line.
 // The flag argument defines the logging properties.
 func New(out io.Writer, prefix string, flag int) *Logger {
-	var l = &Logger{out: out, prefix: []byte(prefix), flag: flag}
+	var l = &Logger{prefix: []byte(prefix), flag: flag, limits: newLineLimits()}
+	l.setOut(out)
 	l.reprocessPrefix()
 	return l
 }
 
+// clone returns a new Logger with the same output and settings as l, but
+// with none of l's line state, and with line limits of its own.
+func (l *Logger) clone() *Logger {
+	return &Logger{
+		prefix:                  l.prefix,
+		flag:                    l.flag,
+		out:                     l.out,
+		helperFunc:              l.helperFunc,
+		prefixFormatted:         l.prefixFormatted,
+		partialLinesEnabled:     l.partialLinesEnabled,
+		colorEnabled:            l.colorEnabled,
+		colorTemplateEnabled:    l.colorTemplateEnabled,
+		autoAppendNewline:       l.autoAppendNewline,
+		colorRegexp:             l.colorRegexp,
+		termWidth:               l.termWidth,
+		callerSkip:              l.callerSkip,
+		limits:                  l.limits.clone(),
+		held:                    l.held,
+		sinks:                   append([]*Logger(nil), l.sinks...),
+		name:                    l.name,
+		level:                   l.level,
+		filter:                  l.filter,
+		theme:                   l.theme,
+		stackTraceDepth:         l.stackTraceDepth,
+		stackTraceAllGoroutines: l.stackTraceAllGoroutines,
+	}
+}
+
 // newStd duplicates some of the work done by New because we can't call
 // reprocessPrefix here (as it creates a circular reference back to DefaultLogger)
 func newStd() *Logger {
-	var l = &Logger{out: os.Stderr, prefix: []byte("@(dim:{isodate}) "), flag: 0}
+	var l = &Logger{prefix: []byte("@(dim:{isodate}) "), flag: 0, limits: newLineLimits()}
+	l.setOut(os.Stderr)
 	l.partialLinesEnabled = &yes
 	l.colorRegexp = regexp.MustCompile("@\\(([\\w,]+?)(:([^)]*?))?\\)")
 	l.colorEnabled = &yes
 	l.colorTemplateEnabled = &yes
 	l.autoAppendNewline = &no
+	l.stackTraceAllGoroutines = &no
+	if journal := stderrJournalWriter(os.Stderr); journal != nil {
+		l.setOut(journal)
+	}
 	// This is like calling reprocessPrefix:
-	l.prefixFormatted = processColorTemplates(l.colorRegexp, l.prefix)
+	l.prefixFormatted = processColorTemplates(l.colorRegexp, "", l.prefix)
 	return l
 }
 
@@ -418,7 +483,7 @@ func (l *Logger) SetOutput(w io.Writer) {
 	ws.lock()
 	defer ws.unlock()
 	l.flushInt()
-	l.out = w
+	l.setOut(w)
 }
 
 // Cheap integer to fixed-width decimal ASCII.  Give a negative width to avoid zero-padding.
@@ -517,10 +582,18 @@ func (l *Logger) formatHeader(buf *[]byte) {
 			*buf = append(*buf, ' ')
 		}
 	}
-	if l.flag&(Lshortfile|Llongfile) != 0 {
+	if l.flag&(Lshortfile|Llongfile|Lrelfile) != 0 {
 		*buf = append(*buf, l.callerFile...)
 		*buf = append(*buf, ':')
 		itoa(buf, l.callerLine, -1)
+		if l.flag&Lfunc != 0 {
+			*buf = append(*buf, ' ')
+		} else {
+			*buf = append(*buf, ": "...)
+		}
+	}
+	if l.flag&Lfunc != 0 {
+		*buf = append(*buf, l.callerFunc...)
 		*buf = append(*buf, ": "...)
 	}
 	if l.flag&Lelapsed != 0 && !l.lineStartTime.IsZero() && l.now != l.lineStartTime {
@@ -685,8 +758,21 @@ func ansiEscapeBytes(colorCode int) []byte {
 	return buf
 }
 
+// Uncolorize returns a copy of buf with its ANSI color escapes removed, or nil
+// if nothing is left.
 func Uncolorize(buf []byte) []byte {
-	return ansiColorRegexp.ReplaceAll(buf, bytesEmpty)
+	var out []byte
+	for i := 0; i < len(buf); {
+		index, length, _, _ := nextAnsiEscape(buf, i)
+		if index > i {
+			if out == nil {
+				out = make([]byte, 0, len(buf)-i)
+			}
+			out = append(out, buf[i:index]...)
+		}
+		i = index + length
+	}
+	return out
 }
 
 func trimString(buf []byte, length int) []byte {
@@ -694,15 +780,22 @@ func trimString(buf []byte, length int) []byte {
 		return bytesEmpty
 	}
 	tmp := []byte{}
-	for _, groups := range ansiColorOrCharRegexp.FindAllSubmatch(buf, -1) {
-		tmp = append(tmp, groups[0]...)
-		if len(groups[1]) == 0 {
-			// This match was not an ANSI escape, so count it towards the length
+	for i := 0; i < len(buf); {
+		if escapeLength, _, multiple := scanAnsiEscape(buf[i:]); escapeLength > 0 && !multiple {
+			tmp = append(tmp, buf[i:i+escapeLength]...)
+			i += escapeLength
+			continue
+		}
+		r, size := utf8.DecodeRune(buf[i:])
+		if r != '\n' {
+			// This is not an ANSI escape, so count it towards the length
+			tmp = append(tmp, buf[i:i+size]...)
 			length -= 1
 			if length <= 0 {
 				return tmp
 			}
 		}
+		i += size
 	}
 	return tmp
 }
@@ -715,7 +808,7 @@ func trimStringEllipsis(buf []byte, length int) []byte {
 }
 
 func VisibleStringLen(buf []byte) int {
-	return utf8.RuneCount(Uncolorize(buf))
+	return visibleRuneCount(buf)
 }
 
 func (l *Logger) getFormattedLine(line []byte) []byte {
@@ -733,13 +826,16 @@ func (l *Logger) getFormattedLine(line []byte) []byte {
 func (l *Logger) reprocessPrefix() {
 	colorTemplateRegexp := l.getColorTemplateRegexp()
 	if colorTemplateRegexp != nil {
-		l.prefixFormatted = processColorTemplates(colorTemplateRegexp, l.prefix)
+		l.prefixFormatted = processColorTemplates(colorTemplateRegexp, l.getTheme(), l.prefix)
 	} else {
 		l.prefixFormatted = l.prefix
 	}
 }
 
-func processColorTemplates(colorTemplateRegexp *regexp.Regexp, buf []byte) []byte {
+// processColorTemplates replaces the color templates in buf with ANSI escapes,
+// looking up codes in the theme called theme (or the default theme if it is
+// empty).
+func processColorTemplates(colorTemplateRegexp *regexp.Regexp, theme string, buf []byte) []byte {
 	// We really want ReplaceAllSubmatchFunc, i.e.: https://github.com/golang/go/issues/5690
 	// Instead we call FindSubmatch on each match, which means that backtracking may not be
 	// used in custom Regexps (matches must also match on themselves without context).
@@ -748,7 +844,11 @@ func processColorTemplates(colorTemplateRegexp *regexp.Regexp, buf []byte) []byt
 		groups := colorTemplateRegexp.FindSubmatch(token)
 		var ansiActive ActiveAnsiCodes
 		for _, codeBytes := range bytes.Split(groups[1], bytesComma) {
-			colorCode, ok := ansiColorCodes[string(codeBytes)]
+			colorCode, ok := lookupColorCode(theme, string(codeBytes))
+			if string(codeBytes) == "hash" {
+				// Color by the text itself, e.g. @(hash:worker-3)
+				colorCode, ok = HashColor(string(groups[3])), true
+			}
 			if !ok {
 				// Don't modify the text if we don't recognize any of the codes
 				return groups[0]
@@ -770,7 +870,7 @@ func processColorTemplates(colorTemplateRegexp *regexp.Regexp, buf []byte) []byt
 func (l *Logger) applyColorTemplates(s string) string {
 	colorTemplateRegexp := l.getColorTemplateRegexp()
 	if colorTemplateRegexp != nil {
-		return string(processColorTemplates(colorTemplateRegexp, []byte(s)))
+		return compileTemplate(colorTemplateRegexp, l.getTheme(), s)
 	} else {
 		return s
 	}
@@ -828,6 +928,7 @@ func (l *Logger) injectAtVirtualCursor(input []byte) {
 }
 
 func (l *Logger) Output(calldepth int, _s string) error {
+	l.helper()()
 	return l.intOutput(calldepth+1, []byte(_s), false)
 }
 
@@ -838,6 +939,7 @@ func (l *Logger) Output(calldepth int, _s string) error {
 // provided for generality, although at the moment on all pre-defined
 // paths it will be 2.
 func (l *Logger) intOutput(calldepth int, s []byte, haveLock bool) error {
+	l.helper()()
 	ws := getWriterState(l.out)
 	if !haveLock {
 		ws.lock()
@@ -850,6 +952,10 @@ func (l *Logger) intOutput(calldepth int, s []byte, haveLock bool) error {
 	if l.isClosed {
 		return errors.New("Attempted to write to closed Logger.")
 	}
+	if len(l.sinks) > 0 {
+		l.forward(calldepth+1, s)
+		return nil
+	}
 	// This is kind of kludgy, but better than nothing:
 	s = []byte(strings.Replace(string(s), "\t", "        ", -1))
 	if l.isAutoNewlineEnabled() && len(s) > 0 && s[len(s)-1] != byteNewline {
@@ -879,27 +985,13 @@ func (l *Logger) intOutput(calldepth int, s []byte, haveLock bool) error {
 		if indexNewline == -1 {
 			break
 		}
-		l.buf = l.buf[indexNewline+1:]
-		l.cursorByteIndex = 0
-		if l.flag&(Lshortfile|Llongfile) != 0 && len(l.callerFile) == 0 {
+		l.consumeLine(indexNewline + 1)
+		if (l.flag&callerFlags != 0 || l.limits.needsCallSite() || wantsCaller(l.out)) && len(l.callerFile) == 0 {
 			// release lock while getting caller info - it's expensive.
 			if !haveLock {
 				ws.unlock()
 			}
-			var ok bool
-			_, l.callerFile, l.callerLine, ok = runtime.Caller(calldepth)
-			if !ok {
-				l.callerFile = "???"
-				l.callerLine = 0
-			}
-			if l.flag&Lshortfile != 0 {
-				for i := len(l.callerFile) - 1; i > 0; i-- {
-					if l.callerFile[i] == '/' {
-						l.callerFile = l.callerFile[i+1:]
-						break
-					}
-				}
-			}
+			l.captureCaller(calldepth)
 			if !haveLock {
 				ws.lock()
 			}
@@ -907,7 +999,7 @@ func (l *Logger) intOutput(calldepth int, s []byte, haveLock bool) error {
 		// ansiActive := getActiveAnsiCodes(currLine)
 		ws.removeTempLogger(l)
 		l.tempLineActive = false
-		writeLine(l.out, l.getFormattedLine(currLine))
+		l.completeLine(currLine)
 		wroteFullLine = true
 		// // XXX This is probably inefficient?:
 		// prepends := []byte{}
@@ -925,6 +1017,16 @@ func (l *Logger) intOutput(calldepth int, s []byte, haveLock bool) error {
 	if wroteFullLine {
 		l.callerFile = ""
 		l.callerLine = 0
+		l.callerFunc = ""
+		l.callerPC = 0
+		if len(l.buf) == 0 {
+			l.lineLevel = LevelInfo
+			l.lineFields = nil
+			l.endLineContext()
+		}
+	}
+	if _, ok := l.out.(LineWriter); ok {
+		return nil
 	}
 	if !l.tempLineActive && l.isPartialLinesEnabled() && VisibleStringLen(l.buf) > 0 {
 		ws.addTempLogger(l)
@@ -935,142 +1037,256 @@ func (l *Logger) intOutput(calldepth int, s []byte, haveLock bool) error {
 	return nil
 }
 
+// consumeLine removes the first n bytes, a completed line and its newline,
+// from l.buf. The cursor stays where it was in any text written after the
+// newline, so that the next write continues that text rather than
+// overwriting it.
+func (l *Logger) consumeLine(n int) {
+	l.buf = l.buf[n:]
+	l.cursorByteIndex -= n
+	if l.cursorByteIndex < 0 {
+		l.cursorByteIndex = 0
+	}
+}
+
 func (l *Logger) truncateBuf() {
 	l.buf = l.buf[:0]
 	l.cursorByteIndex = 0
+	l.eachSink(func(sink *Logger) { sink.truncateBuf() })
 }
 
 // Printf calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Printf(format string, v ...interface{}) {
+	l.helper()()
+	l.printf(3, LevelInfo, format, v...)
+}
+
+func (l *Logger) printf(calldepth int, level Level, format string, v ...interface{}) {
+	l.helper()()
 	ws := getWriterState(l.out)
 	ws.lock()
 	defer ws.unlock()
-	l.intOutput(2, []byte(fmt.Sprintf(l.applyColorTemplates(format), v...)), true)
+	if !l.enabled(calldepth, level) {
+		return
+	}
+	l.startLevel(level)
+	v = l.wrapErrorArgs(format, v, false)
+	l.intOutput(calldepth, []byte(fmt.Sprintf(l.applyColorTemplates(format), v...)), true)
 }
 
 // Print calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Print.
-func (l *Logger) Print(v ...interface{}) { l.intOutput(2, []byte(fmt.Sprint(v...)), false) }
+func (l *Logger) Print(v ...interface{}) {
+	l.helper()()
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	if !l.enabled(2, LevelInfo) {
+		return
+	}
+	l.intOutput(2, []byte(fmt.Sprint(v...)), true)
+}
 
 // Log calls l.Output to print to the logger, adding a newline at the end of the format string.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Log(format string, v ...interface{}) {
-	l.Printf(format+"\n", v...)
+	l.helper()()
+	l.printf(3, LevelInfo, format+"\n", v...)
 }
 
 // Info is a synomym for Log
 func (l *Logger) Info(format string, v ...interface{}) {
-	l.Log(format, v...)
+	l.helper()()
+	l.printf(3, LevelInfo, format+"\n", v...)
+}
+
+// Debug writes a line like Log at LevelDebug, which is hidden unless the
+// level threshold of the logger allows it (see SetLevel).
+func (l *Logger) Debug(format string, v ...interface{}) {
+	l.helper()()
+	l.printf(3, LevelDebug, format+"\n", v...)
+}
+
+// Warn writes a line like Log at LevelWarn.
+func (l *Logger) Warn(format string, v ...interface{}) {
+	l.helper()()
+	l.printf(3, LevelWarn, format+"\n", v...)
 }
 
 func (l *Logger) Replacef(format string, v ...interface{}) {
+	l.helper()()
 	ws := getWriterState(l.out)
 	ws.lock()
 	defer ws.unlock()
+	if !l.enabled(2, LevelInfo) {
+		return
+	}
 	l.truncateBuf()
 	l.intOutput(2, []byte(fmt.Sprintf(l.applyColorTemplates(format), v...)), true)
 }
 
 func (l *Logger) Replace(v ...interface{}) {
+	l.helper()()
 	ws := getWriterState(l.out)
 	ws.lock()
 	defer ws.unlock()
+	if !l.enabled(2, LevelInfo) {
+		return
+	}
 	l.truncateBuf()
 	l.intOutput(2, []byte(fmt.Sprint(v...)), true)
 }
 
 // Println calls l.intOutput to print to the logger.
 // Arguments are handled in the manner of fmt.Println.
-func (l *Logger) Println(v ...interface{}) { l.intOutput(2, []byte(fmt.Sprintln(v...)), false) }
+func (l *Logger) Println(v ...interface{}) {
+	l.helper()()
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	if !l.enabled(2, LevelInfo) {
+		return
+	}
+	l.intOutput(2, []byte(fmt.Sprintln(v...)), true)
+}
 
+// Error writes a line like Log, except that any error arguments formatted with
+// %v, %s or %E are rendered along with their chain of causes.
 func (l *Logger) Error(format string, v ...interface{}) {
+	l.helper()()
+	l.error(4, format, v...)
+}
+
+func (l *Logger) error(calldepth int, format string, v ...interface{}) {
+	l.helper()()
 	if !strings.HasSuffix(format, "\n") {
 		format += "\n"
 	}
-	l.Printf(format, v...)
+	l.printf(calldepth, LevelError, format, l.wrapErrorArgs(format, v, true)...)
 }
 
-// Fatal is equivalent to l.Print() followed by a call to os.Exit(1).
+// Fatal is equivalent to l.Print() at LevelError, followed by a call to
+// os.Exit(1).
 func (l *Logger) Fatal(v ...interface{}) {
-	l.intOutput(2, []byte(fmt.Sprint(v...)), false)
-	osExit()
+	l.helper()()
+	ws := getWriterState(l.out)
+	ws.lock()
+	l.raiseLevel(LevelError)
+	l.intOutput(2, []byte(fmt.Sprint(v...)), true)
+	ws.unlock()
+	osExit(1)
 }
 
-// Fatalf is equivalent to l.Printf() followed by a call to os.Exit(1).
+// Fatalf is equivalent to l.Printf() at LevelError, followed by a call to
+// os.Exit(1).
 func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.helper()()
 	ws := getWriterState(l.out)
 	ws.lock()
+	l.raiseLevel(LevelError)
 	l.intOutput(2, []byte(fmt.Sprintf(l.applyColorTemplates(format), v...)), true)
 	ws.unlock()
-	osExit()
+	osExit(1)
 }
 
-// Fatalln is equivalent to l.Println() followed by a call to os.Exit(1).
+// Fatalln is equivalent to l.Println() at LevelError, followed by a call to
+// os.Exit(1).
 func (l *Logger) Fatalln(v ...interface{}) {
-	l.intOutput(2, []byte(fmt.Sprintln(v...)), false)
-	osExit()
+	l.helper()()
+	ws := getWriterState(l.out)
+	ws.lock()
+	l.raiseLevel(LevelError)
+	l.intOutput(2, []byte(fmt.Sprintln(v...)), true)
+	ws.unlock()
+	osExit(1)
+}
+
+// FatalCode is equivalent to l.Print() at LevelError, followed by a call to
+// os.Exit(code).
+func (l *Logger) FatalCode(code int, v ...interface{}) {
+	l.helper()()
+	ws := getWriterState(l.out)
+	ws.lock()
+	l.raiseLevel(LevelError)
+	l.intOutput(2, []byte(fmt.Sprint(v...)), true)
+	ws.unlock()
+	osExit(code)
+}
+
+// FatalCodef is equivalent to l.Printf() at LevelError, followed by a call to
+// os.Exit(code).
+func (l *Logger) FatalCodef(code int, format string, v ...interface{}) {
+	l.helper()()
+	ws := getWriterState(l.out)
+	ws.lock()
+	l.raiseLevel(LevelError)
+	l.intOutput(2, []byte(fmt.Sprintf(l.applyColorTemplates(format), v...)), true)
+	ws.unlock()
+	osExit(code)
 }
 
-// Panic is equivalent to l.Print() followed by a call to panic().
+// Panic is equivalent to l.Print() at LevelError, followed by a call to
+// panic().
 func (l *Logger) Panic(v ...interface{}) {
+	l.helper()()
 	s := fmt.Sprint(v...)
-	l.intOutput(2, []byte(s), false)
+	ws := getWriterState(l.out)
+	ws.lock()
+	l.raiseLevel(LevelError)
+	l.intOutput(2, []byte(s), true)
 	l.flushInt()
+	ws.unlock()
 	panic(s)
 }
 
-// Panicf is equivalent to l.Printf() followed by a call to panic().
+// Panicf is equivalent to l.Printf() at LevelError, followed by a call to
+// panic().
 func (l *Logger) Panicf(format string, v ...interface{}) {
+	l.helper()()
 	ws := getWriterState(l.out)
 	ws.lock()
 	s := fmt.Sprintf(l.applyColorTemplates(format), v...)
+	l.raiseLevel(LevelError)
 	l.intOutput(2, []byte(s), true)
 	l.flushInt()
 	ws.unlock()
 	panic(s)
 }
 
-// Panicln is equivalent to l.Println() followed by a call to panic().
+// Panicln is equivalent to l.Println() at LevelError, followed by a call to
+// panic().
 func (l *Logger) Panicln(v ...interface{}) {
+	l.helper()()
 	s := fmt.Sprintln(v...)
-	l.intOutput(2, []byte(s), false)
+	ws := getWriterState(l.out)
+	ws.lock()
+	l.raiseLevel(LevelError)
+	l.intOutput(2, []byte(s), true)
+	ws.unlock()
 	panic(s)
 }
 
+// Bail writes a stack trace of the calling goroutine (omitting alog's own
+// frames) and the error, then panics with err.
 func (l *Logger) Bail(err error) {
+	l.helper()()
 	// This works best if l.out == os.Stderr, but it should kind of work regardless
+	frames := CaptureStack(0)
 	ws := getWriterState(l.out)
 	ws.lock()
 	l.flushInt()
-	size := 4096
-	for {
-		buf := make([]byte, size)
-		bytesWritten := runtime.Stack(buf, false)
-		if bytesWritten == size {
-			size *= 2
-			continue
-		}
-		stackTrace := strings.TrimSpace(string(buf[:bytesWritten]))
-		lines := strings.Split(stackTrace, "\n")
-		for i, line := range lines {
-			// Try to cut out the Bail() call from the stack trace:
-			if (i == 1 || i == 3) && strings.Contains(line, "ansi-log.(*Logger).Bail") {
-				continue
-			}
-			if (i == 2 || i == 4) && strings.Contains(line, "tillberg/ansi-log/log.go") {
-				continue
-			}
-			l.intOutput(2, []byte(line+"\n"), true)
-		}
-		break
-	}
-	l.intOutput(2, []byte(fmt.Sprintf("Bailed due to error: %s\n", err.Error())), true)
+	l.raiseLevel(LevelError)
+	l.intOutput(2, l.appendStackTrace(nil, frames), true)
+	l.raiseLevel(LevelError)
+	l.intOutput(2, []byte("Bailed due to error: "), true)
+	l.intOutput(2, append(appendErrorChain(nil, l.getTheme(), err, l.getStackTraceDepth()), '\n'), true)
 	ws.unlock()
 	panic(err)
 }
 
 func (l *Logger) BailIf(err error) {
+	l.helper()()
 	if err != nil {
 		l.Bail(err)
 	}
@@ -1092,6 +1308,62 @@ func (l *Logger) SetFlags(flag int) {
 	l.flag = flag
 }
 
+// CallerSkip returns the number of additional stack frames skipped when
+// computing caller info for Lshortfile, Llongfile, Lrelfile and Lfunc.
+func (l *Logger) CallerSkip() int {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	return l.callerSkip
+}
+
+// SetCallerSkip sets the number of additional stack frames to skip when
+// computing caller info. Helpers that wrap a Logger should set this to the
+// number of wrapper frames so that their caller is reported instead.
+func (l *Logger) SetCallerSkip(skip int) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.callerSkip = skip
+}
+
+// WithCallerSkip returns a copy of the logger that skips skip more stack
+// frames than l does when computing caller info. The copy shares l's output
+// and settings but keeps its own partial line. Unlike a Child, it shares l's
+// line limits, so repeats, rate limits and sampling count the lines of both.
+func (l *Logger) WithCallerSkip(skip int) *Logger {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	c := l.clone()
+	c.callerSkip += skip
+	c.limits = l.limits
+	return c
+}
+
+// Child returns a new Logger that shares l's output and settings, with
+// prefix added after l's prefix. The child keeps its own partial line, so its
+// unfinished output is shown as a temp line of its own. For a tee, the child
+// is a tee of children of each of its sinks.
+func (l *Logger) Child(prefix string) *Logger {
+	ws := getWriterState(l.out)
+	ws.lock()
+	if len(l.sinks) > 0 {
+		sinks := append([]*Logger{}, l.sinks...)
+		ws.unlock()
+		var children []*Logger
+		for _, sink := range sinks {
+			children = append(children, sink.Child(prefix))
+		}
+		return NewTee(children...)
+	}
+	defer ws.unlock()
+	c := l.clone()
+	c.prefix = append(append([]byte{}, l.prefix...), prefix...)
+	c.reprocessPrefix()
+	return c
+}
+
 // Prefix returns the output prefix for the logger.
 func (l *Logger) Prefix() string {
 	ws := getWriterState(l.out)
@@ -1110,6 +1382,7 @@ func (l *Logger) SetPrefix(prefix string) {
 }
 
 func (l *Logger) Write(p []byte) (n int, err error) {
+	l.helper()()
 	err = l.intOutput(2, p, false)
 	return len(p), err
 }
@@ -1118,27 +1391,44 @@ func (l *Logger) Colorify(s string) string {
 	ws := getWriterState(l.out)
 	ws.lock()
 	defer ws.unlock()
-	return l.applyColorTemplates(s)
+	// Not compileTemplate, which is meant for format strings; strings to
+	// colorize are more likely to be one-offs that would churn the cache
+	colorTemplateRegexp := l.getColorTemplateRegexp()
+	if colorTemplateRegexp == nil {
+		return s
+	}
+	return string(processColorTemplates(colorTemplateRegexp, l.getTheme(), []byte(s)))
 }
 
 func (l *Logger) flushInt() {
+	l.helper()()
 	if len(l.buf) > 0 {
 		l.intOutput(2, []byte("\n"), true)
 	}
+	l.flushRepeated()
+	l.eachSink(func(sink *Logger) { sink.flushInt() })
 }
 
 func (l *Logger) closeInt() {
 	l.isClosed = true
 }
 
+// Flush completes the logger's partial line, if it has one, and then waits
+// for the output to be written if it is an AsyncWriter.
 func (l *Logger) Flush() {
 	ws := getWriterState(l.out)
 	ws.lock()
-	defer ws.unlock()
 	l.flushInt()
+	out := l.out
+	ws.unlock()
+	// Wait for the queue without the lock, so that other goroutines can log
+	if async, ok := out.(*AsyncWriter); ok {
+		async.Flush()
+	}
 }
 
 func (l *Logger) Close() error {
+	l.helper()()
 	ws := getWriterState(l.out)
 	ws.lock()
 	defer ws.unlock()
@@ -1147,6 +1437,9 @@ func (l *Logger) Close() error {
 	}
 	ws.removeTempLogger(l)
 	l.closeInt()
+	for _, sink := range l.sinks {
+		sink.Close()
+	}
 	return nil
 }
 
@@ -1165,6 +1458,15 @@ func (l *Logger) SetColorEnabled(flag bool) {
 	defer ws.unlock()
 	l.colorEnabled = boolPointer(flag)
 }
+
+// ColorEnabled returns whether the logger writes colors, or else removes them.
+func (l *Logger) ColorEnabled() bool {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	return l.isColorEnabled()
+}
+
 func (l *Logger) EnableColor()  { l.SetColorEnabled(true) }
 func (l *Logger) DisableColor() { l.SetColorEnabled(false) }
 
@@ -1208,6 +1510,9 @@ func (l *Logger) SetMultilineEnabled(flag bool) {
 	defer ws.unlock()
 	getWriterState(l.out).flushAll()
 	getWriterState(l.out).multiline = flag
+	if async, ok := l.out.(*AsyncWriter); ok {
+		async.setMultiline(flag)
+	}
 }
 func (l *Logger) EnableMultilineMode()  { l.SetMultilineEnabled(true) }
 func (l *Logger) EnableSinglelineMode() { l.SetMultilineEnabled(false) }
@@ -1223,7 +1528,7 @@ func SetOutput(w io.Writer) {
 	ws.lock()
 	defer ws.unlock()
 	DefaultLogger.flushInt()
-	DefaultLogger.out = w
+	DefaultLogger.setOut(w)
 }
 
 // Flags returns the output flags for the standard logger.
@@ -1236,6 +1541,11 @@ func SetFlags(flag int) {
 	DefaultLogger.SetFlags(flag)
 }
 
+// ColorEnabled returns whether the standard logger writes colors.
+func ColorEnabled() bool {
+	return DefaultLogger.ColorEnabled()
+}
+
 // Prefix returns the output prefix for the standard logger.
 func Prefix() string {
 	return DefaultLogger.Prefix()
@@ -1251,38 +1561,69 @@ func SetPrefix(prefix string) {
 // Print calls Output to print to the standard logger.
 // Arguments are handled in the manner of fmt.Print.
 func Print(v ...interface{}) {
-	DefaultLogger.intOutput(2, []byte(fmt.Sprint(v...)), false)
+	DefaultLogger.helper()()
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	defer ws.unlock()
+	if !DefaultLogger.enabled(2, LevelInfo) {
+		return
+	}
+	DefaultLogger.intOutput(2, []byte(fmt.Sprint(v...)), true)
 }
 
 // Printf calls Output to print to the standard logger.
 // Arguments are handled in the manner of fmt.Printf.
 func Printf(format string, v ...interface{}) {
+	DefaultLogger.helper()()
 	ws := getWriterState(DefaultLogger.out)
 	ws.lock()
 	defer ws.unlock()
+	if !DefaultLogger.enabled(2, LevelInfo) {
+		return
+	}
 	DefaultLogger.intOutput(2, []byte(fmt.Sprintf(DefaultLogger.applyColorTemplates(format), v...)), true)
 }
 
 func Log(format string, v ...interface{}) {
-	DefaultLogger.Log(format, v...)
+	DefaultLogger.helper()()
+	DefaultLogger.printf(3, LevelInfo, format+"\n", v...)
 }
 
 func Info(format string, v ...interface{}) {
-	DefaultLogger.Info(format, v...)
+	DefaultLogger.helper()()
+	DefaultLogger.printf(3, LevelInfo, format+"\n", v...)
+}
+
+func Debug(format string, v ...interface{}) {
+	DefaultLogger.helper()()
+	DefaultLogger.printf(3, LevelDebug, format+"\n", v...)
+}
+
+func Warn(format string, v ...interface{}) {
+	DefaultLogger.helper()()
+	DefaultLogger.printf(3, LevelWarn, format+"\n", v...)
 }
 
 func Replace(v ...interface{}) {
+	DefaultLogger.helper()()
 	ws := getWriterState(DefaultLogger.out)
 	ws.lock()
 	defer ws.unlock()
+	if !DefaultLogger.enabled(2, LevelInfo) {
+		return
+	}
 	DefaultLogger.truncateBuf()
 	DefaultLogger.intOutput(2, []byte(fmt.Sprint(v...)), true)
 }
 
 func Replacef(format string, v ...interface{}) {
+	DefaultLogger.helper()()
 	ws := getWriterState(DefaultLogger.out)
 	ws.lock()
 	defer ws.unlock()
+	if !DefaultLogger.enabled(2, LevelInfo) {
+		return
+	}
 	DefaultLogger.truncateBuf()
 	DefaultLogger.intOutput(2, []byte(fmt.Sprintf(DefaultLogger.applyColorTemplates(format), v...)), true)
 }
@@ -1290,65 +1631,129 @@ func Replacef(format string, v ...interface{}) {
 // Println calls Output to print to the standard logger.
 // Arguments are handled in the manner of fmt.Println.
 func Println(v ...interface{}) {
-	DefaultLogger.intOutput(2, []byte(fmt.Sprintln(v...)), false)
+	DefaultLogger.helper()()
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	defer ws.unlock()
+	if !DefaultLogger.enabled(2, LevelInfo) {
+		return
+	}
+	DefaultLogger.intOutput(2, []byte(fmt.Sprintln(v...)), true)
 }
 
 func Error(format string, v ...interface{}) {
-	DefaultLogger.Error(format, v...)
+	DefaultLogger.helper()()
+	DefaultLogger.error(4, format, v...)
 }
 
-// Fatal is equivalent to Print() followed by a call to os.Exit(1).
+// Fatal is equivalent to Print() at LevelError, followed by a call to
+// os.Exit(1).
 func Fatal(v ...interface{}) {
-	DefaultLogger.intOutput(2, []byte(fmt.Sprint(v...)), false)
-	osExit()
+	DefaultLogger.helper()()
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	DefaultLogger.raiseLevel(LevelError)
+	DefaultLogger.intOutput(2, []byte(fmt.Sprint(v...)), true)
+	ws.unlock()
+	osExit(1)
 }
 
-// Fatalf is equivalent to Printf() followed by a call to os.Exit(1).
+// Fatalf is equivalent to Printf() at LevelError, followed by a call to
+// os.Exit(1).
 func Fatalf(format string, v ...interface{}) {
+	DefaultLogger.helper()()
 	ws := getWriterState(DefaultLogger.out)
 	ws.lock()
+	DefaultLogger.raiseLevel(LevelError)
 	DefaultLogger.intOutput(2, []byte(fmt.Sprintf(DefaultLogger.applyColorTemplates(format), v...)), true)
 	ws.unlock()
-	osExit()
+	osExit(1)
 }
 
-// Fatalln is equivalent to Println() followed by a call to os.Exit(1).
+// Fatalln is equivalent to Println() at LevelError, followed by a call to
+// os.Exit(1).
 func Fatalln(v ...interface{}) {
-	DefaultLogger.intOutput(2, []byte(fmt.Sprintln(v...)), false)
-	osExit()
+	DefaultLogger.helper()()
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	DefaultLogger.raiseLevel(LevelError)
+	DefaultLogger.intOutput(2, []byte(fmt.Sprintln(v...)), true)
+	ws.unlock()
+	osExit(1)
+}
+
+// FatalCode is equivalent to Print() at LevelError, followed by a call to
+// os.Exit(code).
+func FatalCode(code int, v ...interface{}) {
+	DefaultLogger.helper()()
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	DefaultLogger.raiseLevel(LevelError)
+	DefaultLogger.intOutput(2, []byte(fmt.Sprint(v...)), true)
+	ws.unlock()
+	osExit(code)
+}
+
+// FatalCodef is equivalent to Printf() at LevelError, followed by a call to
+// os.Exit(code).
+func FatalCodef(code int, format string, v ...interface{}) {
+	DefaultLogger.helper()()
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	DefaultLogger.raiseLevel(LevelError)
+	DefaultLogger.intOutput(2, []byte(fmt.Sprintf(DefaultLogger.applyColorTemplates(format), v...)), true)
+	ws.unlock()
+	osExit(code)
 }
 
-// Panic is equivalent to Print() followed by a call to panic().
+// Panic is equivalent to Print() at LevelError, followed by a call to
+// panic().
 func Panic(v ...interface{}) {
+	DefaultLogger.helper()()
 	s := fmt.Sprint(v...)
-	DefaultLogger.intOutput(2, []byte(s), false)
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	DefaultLogger.raiseLevel(LevelError)
+	DefaultLogger.intOutput(2, []byte(s), true)
 	DefaultLogger.flushInt()
+	ws.unlock()
 	panic(s)
 }
 
-// Panicf is equivalent to Printf() followed by a call to panic().
+// Panicf is equivalent to Printf() at LevelError, followed by a call to
+// panic().
 func Panicf(format string, v ...interface{}) {
+	DefaultLogger.helper()()
 	ws := getWriterState(DefaultLogger.out)
 	ws.lock()
 	s := fmt.Sprintf(DefaultLogger.applyColorTemplates(format), v...)
+	DefaultLogger.raiseLevel(LevelError)
 	DefaultLogger.intOutput(2, []byte(s), true)
 	DefaultLogger.flushInt()
 	ws.unlock()
 	panic(s)
 }
 
-// Panicln is equivalent to Println() followed by a call to panic().
+// Panicln is equivalent to Println() at LevelError, followed by a call to
+// panic().
 func Panicln(v ...interface{}) {
+	DefaultLogger.helper()()
 	s := fmt.Sprintln(v...)
-	DefaultLogger.intOutput(2, []byte(s), false)
+	ws := getWriterState(DefaultLogger.out)
+	ws.lock()
+	DefaultLogger.raiseLevel(LevelError)
+	DefaultLogger.intOutput(2, []byte(s), true)
+	ws.unlock()
 	panic(s)
 }
 
 func Bail(err error) {
+	DefaultLogger.helper()()
 	DefaultLogger.Bail(err)
 }
 
 func BailIf(err error) {
+	DefaultLogger.helper()()
 	DefaultLogger.BailIf(err)
 }
 
@@ -1366,23 +1771,14 @@ func EnableMultilineMode()                      { DefaultLogger.EnableMultilineM
 func EnableSinglelineMode()                     { DefaultLogger.EnableSinglelineMode() }
 func Colorify(s string) string                  { return DefaultLogger.Colorify(s) }
 
+// AddAnsiColorCode adds a color template code, e.g. so that @(s:text) shows
+// text in code's color. Codes defined by the theme in use take precedence;
+// use RegisterTheme to restyle those.
 func AddAnsiColorCode(s string, code ColorCode) {
+	ansiColorCodesMutex.Lock()
 	ansiColorCodes[s] = code
-}
-
-func osExit() {
-	// Lock everything and hold the locks permanently. Close (and flush) all Loggers,
-	// then exit with error code 1.
-	// We only hold an RLock on the global mutex to prevent new Loggers from being
-	// added (and mutating the writers map) before we exit. And because use Lock
-	// would result in a deadlock when we try to RLock during a flush operation when
-	// we try to call getWriterState()
-	mutexGlobal.RLock()
-	for _, ws := range writers {
-		ws.lock()
-		ws.closeAll()
-	}
-	os.Exit(1)
+	ansiColorCodesMutex.Unlock()
+	clearTemplateCache()
 }
 
 // Output writes the output for a logging event.  The string s contains
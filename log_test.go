@@ -1,13 +1,29 @@
 package alog
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tillberg/alog/internal/vt"
 )
 
 func TestPrint(t *testing.T) {
@@ -27,6 +43,17 @@ func TestPrint(t *testing.T) {
 	assert.Equal("    falling...\n", buf.String(), "Close should flush any unfinished line by appending a terminating newline")
 }
 
+func TestPrintAfterNewline(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	writer.HidePartialLines()
+	writer.Print("one\ntw")
+	writer.Print("o\nthr")
+	writer.Print("\rthree\n")
+	assert.Equal("one\ntwo\nthree\n", buf.String(), "text after a newline should be continued, not overwritten")
+}
+
 func TestPrintNothing(t *testing.T) {
 	assert := assert.New(t)
 	var buf bytes.Buffer
@@ -440,6 +467,1286 @@ func TestLoggerInception(t *testing.T) {
 	buf.Reset()
 }
 
+func logFromHelper(l *Logger, s string) {
+	l.WithCallerSkip(1).Print(s)
+}
+
+func TestCallerInfo(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", Lshortfile|Lfunc)
+	defer writer.Close()
+	writer.Print("hello\n")
+	assert.Regexp("^log_test\\.go:\\d+ alog\\.TestCallerInfo: hello\n$", buf.String())
+	buf.Reset()
+	writer.Log("hello")
+	assert.Regexp("^log_test\\.go:\\d+ alog\\.TestCallerInfo: hello\n$", buf.String(), "Log should report its own caller")
+	buf.Reset()
+	logFromHelper(writer, "hello\n")
+	assert.Regexp("^log_test\\.go:\\d+ alog\\.TestCallerInfo: hello\n$", buf.String(), "WithCallerSkip should skip the helper frame")
+	buf.Reset()
+	writer.SetFlags(Lrelfile)
+	writer.Print("hello\n")
+	assert.Regexp("^log_test\\.go:\\d+: hello\n$", buf.String())
+	buf.Reset()
+	writer.SetFlags(Lfunc)
+	func() {
+		writer.Print("hello\n")
+	}()
+	assert.Equal("alog.TestCallerInfo.func1: hello\n", buf.String())
+	buf.Reset()
+}
+
+func TestBail(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	defer writer.Close()
+	writer.DisableColor()
+	writer.SetStackTraceDepth(1)
+	err := errors.New("oops")
+	assert.PanicsWithValue(err, func() { writer.BailIf(err) })
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal("alog.TestBail.func1", lines[0][strings.LastIndexByte(lines[0], '/')+1:], "Bail should omit its own frames")
+	assert.Regexp("^    .*/log_test\\.go:\\d+$", lines[1])
+	assert.Regexp("^\\.\\.\\. \\d+ more frames$", lines[2])
+	assert.Equal("Bailed due to error: oops", lines[3])
+}
+
+func TestParseGoroutineStacks(t *testing.T) {
+	assert := assert.New(t)
+	stacks := parseGoroutineStacks("goroutine 1 [running]:\nmain.(*T).M(0x1, 0x2)\n\t/src/main.go:10 +0x25\n\ngoroutine 7 [chan receive]:\nmain.worker()\n\t/src/worker.go:3 +0x1d\ncreated by main.main in goroutine 1\n\t/src/main.go:12 +0x3e\n")
+	assert.Equal([]goroutineStack{
+		{header: "goroutine 1 [running]", frames: []StackFrame{{"main.(*T).M", "/src/main.go", 10}}},
+		{header: "goroutine 7 [chan receive]", frames: []StackFrame{{"main.worker", "/src/worker.go", 3}, {"created by main.main in goroutine 1", "/src/main.go", 12}}},
+	}, stacks)
+}
+
+type joinedErrors []error
+
+func (e joinedErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e joinedErrors) Unwrap() []error { return e }
+
+func TestErrorChain(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "$$ ", 0)
+	defer writer.Close()
+	writer.DisableColor()
+	inner := errors.New("permission denied")
+	err := fmt.Errorf("loading config: %w", fmt.Errorf("open settings.json: %w", inner))
+	writer.Err(err)
+	assert.Equal("$$ loading config\n$$   caused by: open settings.json\n$$     caused by: permission denied\n", buf.String())
+	buf.Reset()
+	writer.Error("failed: %v", fmt.Errorf("sync: %w", joinedErrors{errors.New("a"), errors.New("b")}))
+	assert.Equal("$$ failed: sync\n$$   caused by: a\n$$   caused by: b\n", buf.String())
+	buf.Reset()
+	writer.Printf("plain %v, chained %E\n", err, inner)
+	assert.Equal("$$ plain loading config: open settings.json: permission denied, chained permission denied\n", buf.String())
+	buf.Reset()
+
+	// Only the arguments of %E (and of %v and %s in Error) are rendered as
+	// chains; other verbs see the errors themselves
+	writer.Error("%T %[1]v %[1]q", inner)
+	assert.Equal("$$ *errors.errorString permission denied \"permission denied\"\n", buf.String())
+	buf.Reset()
+	writer.Error("%T: %v", errors.New("x"), err)
+	assert.Equal("$$ *errors.errorString: loading config\n$$   caused by: open settings.json\n$$     caused by: permission denied\n", buf.String())
+	buf.Reset()
+	writer.Printf("%v|%-8E|%*E|%d\n", inner, errors.New("a"), 3, errors.New("b"), 4)
+	assert.Equal("$$ permission denied|a       |  b|4\n", buf.String())
+	buf.Reset()
+	writer.Err(nil)
+	assert.Equal("$$ <nil>\n", buf.String())
+	buf.Reset()
+}
+
+func TestRecover(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+	defer SetPrefix(Prefix())
+	defer SetFlags(Flags())
+	SetPrefix("")
+	SetFlags(0)
+	DisableColor()
+	defer EnableColor()
+	var writer = New(&buf, "", 0)
+	defer writer.Close()
+	writer.Print("working...")
+	buf.Reset()
+	assert.PanicsWithValue("boom", func() {
+		defer Recover()
+		panic("boom")
+	})
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal("", lines[0], "the temp line should be finalized before the trace")
+	assert.Equal("panic: boom", lines[1])
+	assert.Equal("alog.TestRecover.func1", lines[2][strings.LastIndexByte(lines[2], '/')+1:])
+
+	// The panic is logged as an error
+	buf.Reset()
+	SetOutput(NewJSONWriter(&buf))
+	assert.Panics(func() {
+		defer Recover()
+		panic("boom")
+	})
+	var line JSONLine
+	assert.NoError(json.NewDecoder(&buf).Decode(&line))
+	assert.Equal("error", line.Level)
+	assert.Equal("panic: boom", line.Message)
+}
+
+func TestFatalPanics(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	defer writer.Close()
+	SetFatalPanics(true)
+	defer SetFatalPanics(false)
+	handled := false
+	unregister := RegisterExitHandler(func() {
+		assert.Equal("working... done\ngiving up\n", buf.String(), "exit handlers run after flushing")
+		handled = true
+	})
+	t.Cleanup(unregister)
+	writer.Print("working...")
+	assert.PanicsWithValue(FatalError{Code: 3}, func() {
+		writer.Print(" done\n")
+		writer.FatalCode(3, "giving up\n")
+	})
+	assert.True(handled)
+
+	// Unregistered handlers aren't run
+	handled = false
+	unregister()
+	assert.Panics(func() { writer.Fatal("again\n") })
+	assert.False(handled)
+}
+
+func TestCastRecorder(t *testing.T) {
+	assert := assert.New(t)
+	var terminal, cast bytes.Buffer
+	recorder, err := NewCastRecorder(&terminal, &cast, 80, 0)
+	assert.NoError(err)
+	var writer = New(recorder, "", 0)
+	writer.Print("Working...")
+	writer.Print(" done.\n")
+	recorder.Write([]byte("split \xe2\x9c"))
+	recorder.Write([]byte("\x93\n"))
+	assert.NoError(recorder.Close())
+	header, events, err := ReadCast(bytes.NewReader(cast.Bytes()))
+	assert.NoError(err)
+	assert.Equal(2, header.Version)
+	assert.Equal(80, header.Width)
+	assert.Equal(24, header.Height)
+	assert.Equal([]string{"Working...", " done.", "\n", "split ", "✓\n"}, func() (data []string) {
+		for _, event := range events {
+			assert.Equal("o", event.Type)
+			data = append(data, event.Data)
+		}
+		return
+	}())
+	var replayed bytes.Buffer
+	assert.NoError(ReplayCast(bytes.NewReader(cast.Bytes()), &replayed, 0))
+	assert.Equal(terminal.String(), replayed.String())
+}
+
+func TestHTMLWriter(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var html = NewHTMLWriter(&buf, HTMLOptions{})
+	html.Write([]byte("a <b> \033[1;3"))
+	html.Write([]byte("1mbold red\033[22m red\033[0m & \033[38;5;208morange\033[39m\n"))
+	assert.NoError(html.Close())
+	assert.Equal("<pre class=\"alog\">a &lt;b&gt; <span class=\"alog-bold alog-fg-red\">bold red</span><span class=\"alog-fg-red\"> red</span> &amp; <span style=\"color: #ff8700\">orange</span>\n</pre>\n", buf.String())
+	buf.Reset()
+	html = NewHTMLWriter(&buf, HTMLOptions{ResolveScreen: true, Document: true, Title: "build"})
+	var writer = New(html, "", 0)
+	writer.EnableColorTemplate()
+	writer.Printf("@(green:Working...)")
+	writer.Replacef("@(green:Done.)\n")
+	assert.Contains(buf.String(), "<pre class=\"alog\"><span class=\"alog-fg-green\">Done.</span>\n", "complete lines are written right away")
+	assert.NoError(html.Close())
+	assert.Contains(buf.String(), "<title>build</title>")
+	assert.Contains(buf.String(), "<pre class=\"alog\"><span class=\"alog-fg-green\">Done.</span>\n</pre>")
+
+	buf.Reset()
+	html = NewHTMLWriter(&buf, HTMLOptions{})
+	html.Write([]byte("Working 10%\rWorking 50%"))
+	assert.Equal("", buf.String(), "the line could still be redrawn")
+	html.Write([]byte("\rDone       \nnext"))
+	assert.Equal("<pre class=\"alog\">Done\n", buf.String())
+	assert.NoError(html.Close())
+	assert.Equal("<pre class=\"alog\">Done\nnext</pre>\n", buf.String())
+
+	buf.Reset()
+	html = NewHTMLWriter(&buf, HTMLOptions{ResolveScreen: true})
+	writer = New(html, "", 0)
+	writer.SetMultilineEnabled(true)
+	var job = New(html, "", 0)
+	job.Printf("building")
+	writer.Printf("first\n")
+	assert.Equal("<pre class=\"alog\">first\n", buf.String(), "lines above the temp lines are written")
+	job.Printf(" done\n")
+	writer.Printf("second\n")
+	assert.NoError(html.Close())
+	assert.Equal("<pre class=\"alog\">first\nbuilding done\nsecond\n</pre>\n", buf.String())
+}
+
+func TestTee(t *testing.T) {
+	assert := assert.New(t)
+	var termBuf, fileBuf bytes.Buffer
+	term := New(&termBuf, "$$ ", 0)
+	file := New(&fileBuf, "", Lshortfile)
+	file.HidePartialLines()
+	file.DisableColor()
+	var tee = NewTee(term, file)
+	tee.EnableColorTemplate()
+	tee.Printf("@(red:Working...)")
+	assert.Equal("$$ \033[31mWorking...\033[39m", termBuf.String())
+	assert.Equal("", fileBuf.String(), "partial lines are only committed to the file when complete")
+	termBuf.Reset()
+	tee.Printf(" done.\n")
+	assert.Equal(" done.\n", termBuf.String())
+	assert.Regexp("^log_test\\.go:\\d+: Working\\.\\.\\. done\\.\n$", fileBuf.String())
+	termBuf.Reset()
+	fileBuf.Reset()
+	tee.Print("left over")
+	tee.Close()
+	assert.Equal("$$ left over", termBuf.String()[:len("$$ left over")])
+	assert.Regexp("left over\n$", fileBuf.String())
+}
+
+func TestTeeClone(t *testing.T) {
+	assert := assert.New(t)
+	var termBuf, fileBuf bytes.Buffer
+	var tee = NewTee(New(&termBuf, "", 0), New(&fileBuf, "", 0))
+	mutexGlobal.RLock()
+	numWriters := len(writers)
+	mutexGlobal.RUnlock()
+	for i := 0; i < 10; i++ {
+		NewTee().Child("child: ")
+	}
+	mutexGlobal.RLock()
+	assert.Equal(numWriters, len(writers), "tees don't add to writers")
+	mutexGlobal.RUnlock()
+	tee.WithCallerSkip(1).Info("skipped")
+	assert.Equal("skipped\n", termBuf.String())
+	assert.Equal("skipped\n", fileBuf.String())
+}
+
+// blockingWriter blocks every write until it is released.
+type blockingWriter struct {
+	bytes.Buffer
+	release chan bool
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.Buffer.Write(p)
+}
+
+func TestAsyncWriter(t *testing.T) {
+	assert := assert.New(t)
+	slow := &blockingWriter{release: make(chan bool)}
+	async := NewAsyncWriter(slow, 2, AsyncDropOldest)
+	var writer = New(async, "", 0)
+	writer.Print("first\n")
+	// Wait for the first write to be taken off the queue and block
+	isWriting := func() bool {
+		async.mutex.Lock()
+		defer async.mutex.Unlock()
+		return async.writing
+	}
+	for !isWriting() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		writer.Printf("line %d\n", i)
+	}
+	close(slow.release)
+	writer.Flush()
+	assert.Equal("first\n3 lines dropped\nline 3\nline 4\n", slow.String())
+	assert.NoError(async.Close())
+	_, err := async.Write([]byte("closed\n"))
+	assert.Error(err)
+}
+
+func TestAsyncWriterPartialLines(t *testing.T) {
+	assert := assert.New(t)
+	slow := &blockingWriter{release: make(chan bool)}
+	async := NewAsyncWriter(slow, 1, AsyncDropNewest)
+	async.Write([]byte("first\n"))
+	for !func() bool {
+		async.mutex.Lock()
+		defer async.mutex.Unlock()
+		return async.writing
+	}() {
+		time.Sleep(time.Millisecond)
+	}
+	// A line is dropped whole, along with any redraws of it
+	async.Write([]byte("kept\n"))
+	async.Write([]byte("working"))
+	async.Write([]byte("\r\033[Kworking... done\n"))
+	var writer = New(async, "", 0)
+	go func() {
+		// Logging continues while the Logger waits for the queue
+		time.Sleep(10 * time.Millisecond)
+		writer.Print("other\n")
+		close(slow.release)
+	}()
+	writer.Flush()
+	assert.Equal("first\n2 lines dropped\nkept\n", slow.String())
+
+	// Unfinished lines are queued in pieces
+	slow.Reset()
+	async.Write(bytes.Repeat([]byte("."), maxAsyncPartialLine))
+	async.Write([]byte("\n"))
+	assert.NoError(async.Flush())
+	assert.Equal(maxAsyncPartialLine+1, slow.Len())
+
+	// Nothing is dropped in multiline mode
+	slow.Reset()
+	slow.release = make(chan bool)
+	writer.EnableMultilineMode()
+	async.Write([]byte("first\n"))
+	for !func() bool {
+		async.mutex.Lock()
+		defer async.mutex.Unlock()
+		return async.writing
+	}() {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan bool)
+	go func() {
+		async.Write([]byte("second\n"))
+		async.Write([]byte("third\n"))
+		close(done)
+	}()
+	close(slow.release)
+	<-done
+	writer.Flush()
+	assert.Equal("first\nsecond\nthird\n", slow.String())
+	assert.NoError(async.Close())
+}
+
+func TestLimits(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	writer.HidePartialLines()
+	writer.DisableColor()
+	writer.SetCollapseRepeated(true)
+	for i := 0; i < 4; i++ {
+		writer.Log("retrying")
+	}
+	writer.Log("done")
+	writer.Log("done")
+	writer.Flush()
+	assert.Equal("retrying\nlast message repeated 3 times\ndone\nlast message repeated 1 time\n", buf.String())
+
+	// Children inherit the setting but compare their own lines; copies made
+	// by WithCallerSkip share the parent's
+	buf.Reset()
+	a, b := writer.Child("a: "), writer.Child("b: ")
+	skipper := writer.WithCallerSkip(1)
+	a.Log("ready")
+	b.Log("ready")
+	b.Log("ready")
+	writer.Log("ready")
+	skipper.Log("ready")
+	writer.Flush()
+	b.Flush()
+	assert.Equal("a: ready\nb: ready\nready\nlast message repeated 1 time\nb: last message repeated 1 time\n", buf.String())
+	writer.SetCollapseRepeated(false)
+
+	// The notice is also written once the repeats have gone on for a while
+	buf.Reset()
+	writer.limits.repeatDelay = time.Millisecond
+	writer.SetCollapseRepeated(true)
+	writer.Log("waiting")
+	writer.Log("waiting")
+	assert.Eventually(func() bool {
+		ws := getWriterState(&buf)
+		ws.lock()
+		defer ws.unlock()
+		return buf.String() == "waiting\nlast message repeated 1 time\n"
+	}, time.Second, time.Millisecond)
+	writer.SetCollapseRepeated(false)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	writer.limits.now = func() time.Time { return now }
+	buf.Reset()
+	writer.SetRateLimit(1, 2)
+	for i := 0; i < 7; i++ {
+		if i == 5 {
+			// Enough time to refill one token
+			now = now.Add(time.Second)
+		}
+		writer.Log("flood %d", i)
+		if i == 0 {
+			writer.Log("other")
+		}
+	}
+	assert.Equal("flood 0\nother\nflood 1\n3 lines suppressed by rate limit\nflood 5\n", buf.String())
+	writer.SetRateLimit(0, 0)
+
+	buf.Reset()
+	writer.SetSampling(2, 3)
+	for i := 0; i < 10; i++ {
+		writer.Log("sample %d", i)
+	}
+	assert.Equal("sample 0\nsample 1\nsample 4\nsample 7\n", buf.String())
+	writer.SetSampling(0, 0)
+
+	buf.Reset()
+	for i := 0; i < 5; i++ {
+		writer.Once("once %d", i)
+		writer.EveryN(2, "every 2nd %d", i)
+		writer.Every(time.Hour, "hourly %d", i)
+	}
+	writer.Once("another once")
+	now = now.Add(time.Hour)
+	writer.Every(time.Hour, "hourly again")
+	assert.Equal("once 0\nevery 2nd 0\nhourly 0\nevery 2nd 2\nevery 2nd 4\nanother once\nhourly again\n", buf.String())
+}
+
+func TestSyslogWriter(t *testing.T) {
+	assert := assert.New(t)
+	socketPath := filepath.Join(t.TempDir(), "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if !assert.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	syslog, err := NewSyslogWriter(SyslogOptions{Address: socketPath, Facility: SyslogLocal0, Hostname: "host", AppName: "my app"})
+	if !assert.NoError(err) {
+		return
+	}
+	var writer = New(syslog, "", 0)
+	writer.Error("\033[31mfailed\033[0m")
+	packet := make([]byte, 1024)
+	n, err := listener.Read(packet)
+	assert.NoError(err)
+	msg := string(packet[:n])
+	assert.True(strings.HasPrefix(msg, "<131>1 "), msg)
+	assert.True(strings.HasSuffix(msg, fmt.Sprintf(" host my_app %d - - failed", os.Getpid())), msg)
+	assert.NoError(syslog.Close())
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer udp.Close()
+	syslog, err = NewSyslogWriter(SyslogOptions{Network: "udp", Address: udp.LocalAddr().String(), Format: SyslogRFC3164, Hostname: "host", AppName: "app"})
+	if !assert.NoError(err) {
+		return
+	}
+	syslog.Write([]byte("plain "))
+	syslog.Write([]byte("text\n"))
+	n, _, err = udp.ReadFrom(packet)
+	assert.NoError(err)
+	msg = string(packet[:n])
+	assert.True(strings.HasPrefix(msg, "<14>"), msg)
+	assert.True(strings.HasSuffix(msg, fmt.Sprintf(" host app[%d]: plain text", os.Getpid())), msg)
+	assert.NoError(syslog.Close())
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer tcp.Close()
+	syslog, err = NewSyslogWriter(SyslogOptions{Network: "tcp", Address: tcp.Addr().String(), Hostname: "host", AppName: "app"})
+	if !assert.NoError(err) {
+		return
+	}
+	defer syslog.Close()
+	writer = New(syslog, "", 0)
+	conn, err := tcp.Accept()
+	if !assert.NoError(err) {
+		return
+	}
+	readFrame := func(reader *bufio.Reader) string {
+		var length int
+		_, err := fmt.Fscanf(reader, "%d ", &length)
+		assert.NoError(err)
+		frame := make([]byte, length)
+		_, err = io.ReadFull(reader, frame)
+		assert.NoError(err)
+		return string(frame)
+	}
+	writer.Log("first")
+	frame := readFrame(bufio.NewReader(conn))
+	assert.True(strings.HasPrefix(frame, "<14>1 "), frame)
+	assert.True(strings.HasSuffix(frame, " - - first"), frame)
+	// Drop the connection; the writer should reconnect
+	conn.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := tcp.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	var second net.Conn
+	for i := 0; second == nil && i < 100; i++ {
+		writer.Log("again")
+		select {
+		case second = <-accepted:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if !assert.NotNil(second) {
+		return
+	}
+	defer second.Close()
+	frame = readFrame(bufio.NewReader(second))
+	assert.True(strings.HasSuffix(frame, " - - again"), frame)
+
+	// While the server is down, lines are dropped without redialing until the
+	// backoff has passed
+	syslog.mutex.Lock()
+	dial := syslog.dial
+	var dials int
+	down := true
+	syslog.dial = func(network string, address string) (net.Conn, error) {
+		dials++
+		if down {
+			return nil, errors.New("down")
+		}
+		return dial(network, address)
+	}
+	syslog.options.MinBackoff = time.Hour
+	syslog.conn.Close()
+	syslog.conn = nil
+	syslog.mutex.Unlock()
+	for i := 0; i < 5; i++ {
+		writer.Log("lost")
+	}
+	assert.Equal(1, dials)
+	syslog.mutex.Lock()
+	down = false
+	syslog.retryAt = time.Time{}
+	syslog.mutex.Unlock()
+	go func() {
+		conn, err := tcp.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	writer.Log("back")
+	third := <-accepted
+	defer third.Close()
+	reader := bufio.NewReader(third)
+	frame = readFrame(reader)
+	assert.True(strings.HasSuffix(frame, " - - 5 lines dropped while disconnected"), frame)
+	frame = readFrame(reader)
+	assert.True(strings.HasSuffix(frame, " - - back"), frame)
+}
+
+func TestNetworkWriter(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "collector")
+	listener, err := net.Listen("unix", socketPath)
+	if !assert.NoError(err) {
+		return
+	}
+	network, err := NewNetworkWriter(NetworkOptions{
+		Network:      "unix",
+		Address:      socketPath,
+		JSON:         true,
+		SpoolPath:    filepath.Join(dir, "spool"),
+		MaxSpoolSize: 200,
+		MinBackoff:   time.Millisecond,
+		MaxBackoff:   10 * time.Millisecond,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer network.Close()
+	var writer = New(network, "", 0)
+	readLine := func(reader *bufio.Reader) JSONLine {
+		var line JSONLine
+		text, err := reader.ReadString('\n')
+		assert.NoError(err)
+		assert.NoError(json.Unmarshal([]byte(text), &line), text)
+		return line
+	}
+	conn, err := listener.Accept()
+	if !assert.NoError(err) {
+		return
+	}
+	writer.Error("\033[31mone\033[0m")
+	line := readLine(bufio.NewReader(conn))
+	assert.Equal("one", line.Message)
+	assert.Equal("error", line.Level)
+
+	// Restart the collector; lines logged in the meantime are spooled
+	conn.Close()
+	listener.Close()
+	for network.Connected() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		writer.Log("spooled %d", i)
+	}
+	spool, err := os.ReadFile(filepath.Join(dir, "spool"))
+	assert.NoError(err)
+	assert.Equal(2, bytes.Count(spool, []byte("\n")))
+	listener, err = net.Listen("unix", socketPath)
+	if !assert.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	conn, err = listener.Accept()
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	assert.Equal("spooled 0", readLine(reader).Message)
+	assert.Equal("spooled 1", readLine(reader).Message)
+	line = readLine(reader)
+	assert.Equal("3 lines dropped while disconnected", line.Message)
+	assert.Equal("warn", line.Level)
+	writer.Log("after")
+	assert.Equal("after", readLine(reader).Message)
+}
+
+func TestContext(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	writer.HidePartialLines()
+	writer.DisableColor()
+	assert.Equal(DefaultLogger, FromContext(context.Background()))
+	type traceKey struct{}
+	RegisterContextKey("trace_id", traceKey{})
+	ctx := NewContext(context.Background(), writer)
+	ctx = context.WithValue(ctx, traceKey{}, "t1")
+	ctx = WithFields(ctx, "request_id", 42, "user", "a b")
+	ctx = WithFields(ctx, "request_id", 43)
+	assert.Equal(writer, FromContext(ctx))
+	InfoContext(ctx, "handled %s", "request")
+	assert.Equal("handled request trace_id=t1 request_id=43 user=\"a b\"\n", buf.String())
+
+	buf.Reset()
+	writer.Printf("no fields\n")
+	FromContext(ctx).ErrorContext(ctx, "failed: %v", errors.New("oops"))
+	assert.Equal("no fields\nfailed: oops trace_id=t1 request_id=43 user=\"a b\"\n", buf.String())
+
+	// A partial line is finalized when its context is cancelled
+	buf.Reset()
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	writer.PrintfContext(cancelCtx, "waiting...")
+	assert.Equal("", buf.String())
+	cancel()
+	for writer.PartialLine() != "" {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal("waiting... [context canceled]\n", buf.String())
+
+	// ... but not once it has been completed
+	buf.Reset()
+	cancelCtx, cancel = context.WithCancel(context.Background())
+	writer.PrintfContext(cancelCtx, "working...")
+	writer.Printf(" done\n")
+	cancel()
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal("working... done\n", buf.String())
+}
+
+func TestMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	terminal := vt.New()
+	var writer = New(terminal, "", 0)
+	writer.ShowPartialLines()
+	writer.EnableMultilineMode()
+	defer writer.EnableSinglelineMode()
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("finally"))
+	})
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {
+		InfoContext(r.Context(), "handling fast")
+		w.Write([]byte("hello"))
+	})
+	server := httptest.NewServer(writer.Middleware(mux))
+	defer server.Close()
+	waitForLine := func(pattern string) {
+		for i := 0; i < 500; i++ {
+			for _, line := range terminal.Lines() {
+				if regexp.MustCompile(pattern).MatchString(line) {
+					return
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		assert.Fail("line not found", "%s in %q", pattern, terminal.Lines())
+	}
+	slowDone := make(chan bool)
+	go func() {
+		resp, err := http.Get(server.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slowDone <- true
+	}()
+	waitForLine("^GET /slow$")
+	resp, err := http.Get(server.URL + "/fast?x=1")
+	assert.NoError(err)
+	resp.Body.Close()
+	lines := terminal.Lines()
+	assert.Equal("handling fast", lines[0])
+	assert.Regexp("^GET /fast\\?x=1 200 5B +[0-9.]+ms$", lines[1])
+	assert.Equal("GET /slow", lines[2])
+	close(release)
+	<-slowDone
+	waitForLine("^GET /slow 200 7B ")
+	assert.Equal(3, len(terminal.Lines()))
+
+	recorder := httptest.NewRecorder()
+	writer.Middleware(http.NotFoundHandler()).ServeHTTP(recorder, httptest.NewRequest("GET", "/missing", nil))
+	assert.Equal(404, recorder.Code)
+	waitForLine("^GET /missing 404 19B ")
+}
+
+func TestRunCommand(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "[build] ", 0)
+	writer.HidePartialLines()
+	writer.DisableColor()
+	cmd := exec.Command("sh", "-c", "printf '10%%\\r50%%\\rdone\\n'; printf 'warning' >&2; exit 3")
+	code, elapsed, err := writer.RunCommand(cmd, "out: ", "err: ")
+	assert.Equal(3, code)
+	assert.True(elapsed > 0)
+	var exitErr *exec.ExitError
+	assert.True(errors.As(err, &exitErr))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.ElementsMatch([]string{"[build] out: done", "[build] err: warning"}, lines)
+
+	code, _, err = writer.RunCommand(exec.Command("/nonexistent"), "", "")
+	assert.Equal(-1, code)
+	assert.Error(err)
+}
+
+func TestRunCommandProgress(t *testing.T) {
+	assert := assert.New(t)
+	terminal := vt.New()
+	var writer = New(terminal, "[build] ", 0)
+	writer.ShowPartialLines()
+	writer.DisableColor()
+	// The command waits for a line on stdin before each update
+	cmd := exec.Command("sh", "-c", "printf '10%%\\r'; read a; printf '50%%\\r'; read a; printf 'done\\n'")
+	stdin, err := cmd.StdinPipe()
+	if !assert.NoError(err) {
+		return
+	}
+	done := make(chan int)
+	go func() {
+		code, _, _ := writer.RunCommand(cmd, "out: ", "err: ")
+		done <- code
+	}()
+	waitForScreen := func(expected string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) && terminal.String() != expected {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(expected, terminal.String())
+	}
+	// Each update redraws the temp line in place
+	waitForScreen("[build] out: 10%")
+	stdin.Write([]byte("\n"))
+	waitForScreen("[build] out: 50%")
+	stdin.Write([]byte("\n"))
+	assert.Equal(0, <-done)
+	assert.Equal([]string{"[build] out: done"}, terminal.Lines())
+}
+
+func TestMux(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "> ", 0)
+	writer.HidePartialLines()
+	mux := NewMux(writer)
+	api := mux.Logger("api")
+	api.Print("starting\n")
+	worker := mux.Logger("worker-3")
+	assert.Equal(api, mux.Logger("api"))
+	worker.Print("ready\n")
+	api.Print("listening\n")
+	assert.Equal("> api | starting\n> worker-3 | ready\n> api      | listening\n", string(Uncolorize(buf.Bytes())))
+	assert.Contains(buf.String(), string(colorizeCode(nil, HashColor("worker-3"), "worker-3 |")))
+	assert.Equal(HashColor("api"), HashColor("api"))
+
+	writer.EnableColorTemplate()
+	assert.Equal(string(colorizeCode(nil, HashColor("api"), "api")), writer.Colorify("@(hash:api)"))
+}
+
+func TestJob(t *testing.T) {
+	assert := assert.New(t)
+	terminal := vt.New()
+	var writer = New(terminal, "", 0)
+	writer.ShowPartialLines()
+	a := writer.Job("a: ")
+	b := writer.Job("b: ")
+	a.Print("one\n")
+	b.Print("one\n")
+	a.Print("compiling...")
+	assert.Equal([]string{"a: compiling..."}, terminal.Lines())
+	a.Print(" done\n")
+	b.Print("two\n")
+	assert.Equal([]string(nil), terminal.Lines())
+	b.Finish()
+	a.Print("three")
+	assert.Equal([]string{"b: one", "b: two", "a: three"}, terminal.Lines())
+	a.Finish()
+	assert.Equal([]string{"b: one", "b: two", "a: one", "a: compiling... done", "a: three"}, terminal.Lines())
+
+	terminal.Reset()
+	c := writer.Job("c: ")
+	c.Print("held\n")
+	c.Dump()
+	c.Print("failed\n")
+	assert.Equal([]string{"c: held", "c: failed"}, terminal.Lines())
+	c.Finish()
+
+	// Loggers created from a Job hold back their lines along with it
+	terminal.Reset()
+	d := writer.Job("d: ")
+	e := writer.Job("e: ")
+	d.Print("start\n")
+	d.Child("step: ").Print("built\n")
+	e.Print("start\n")
+	e.Finish()
+	d.Named("tests").Print("passed\n")
+	assert.Equal([]string{"e: start"}, terminal.Lines())
+	d.Finish()
+	assert.Equal([]string{"e: start", "d: start", "d: step: built", "d: passed"}, terminal.Lines())
+}
+
+func TestLevels(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	writer.Debug("hidden %d", 1)
+	writer.Info("shown")
+	writer.SetLevel(LevelWarn)
+	writer.Info("hidden")
+	writer.Printf("hidden\n")
+	writer.Warn("warned")
+	writer.Error("failed")
+	assert.Equal("shown\nwarned\nfailed\n", buf.String())
+	assert.Equal(LevelWarn, writer.Level())
+
+	// The level is checked under the writer's lock, so it can be changed
+	// while other goroutines log (run with -race)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			writer.SetLevel(Level(i % 2))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		writer.Print("")
+		writer.Println()
+	}
+	wg.Wait()
+
+	buf.Reset()
+	filter := Filter()
+	t.Cleanup(func() { SetFilter(filter) })
+	writer.SetLevel(LevelInfo)
+	db := writer.Named("leveltest").Named("db")
+	assert.Equal("leveltest/db", db.Name())
+	db.Debug("hidden")
+	SetLevelForName("leveltest", LevelDebug)
+	db.Debug("query")
+	SetLevelForName("LEVELTEST_DB", LevelError)
+	db.Warn("hidden")
+	writer.Debug("hidden")
+	assert.Equal("query\n", buf.String())
+
+	level, err := ParseLevel("WARNING")
+	assert.Nil(err)
+	assert.Equal(LevelWarn, level)
+	_, err = ParseLevel("loud")
+	assert.NotNil(err)
+
+}
+
+func TestConfig(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "alog.conf")
+	os.WriteFile(path, []byte(`# settings
+level = debug
+level.configtest/http = error
+color = off
+partial_lines = false
+prefix = "> "
+term_width = 100
+`), 0644)
+	t.Setenv("ALOG_CONFIG", path)
+	t.Setenv("ALOG_LEVEL", "warn")
+	t.Setenv("ALOG_LEVEL_CONFIGTEST", "info")
+	t.Setenv("ALOG_FORMAT", "json")
+	c, err := ConfigFromEnvironment()
+	assert.Nil(err)
+	assert.Equal(LevelWarn, *c.Level)
+	assert.Equal(map[string]Level{"configtest/http": LevelError, "configtest": LevelInfo}, c.Levels)
+	assert.False(*c.Color)
+	assert.False(*c.PartialLines)
+	assert.Nil(c.Multiline)
+	assert.Equal("> ", *c.Prefix)
+	assert.Equal(100, c.TermWidth)
+	assert.Equal("json", c.Format)
+
+	filter := Filter()
+	t.Cleanup(func() { SetFilter(filter) })
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	other := New(&buf, "", 0).Named("configtest").Named("http")
+	c.Apply(writer)
+	assert.Equal("> ", writer.Prefix())
+	assert.Equal(LevelWarn, writer.Level())
+	assert.Equal(LevelError, writer.Named("configtest").Named("http").Level())
+	// The levels for names only apply to writer and the Loggers created from it
+	assert.Equal(filter, Filter())
+	assert.Equal(LevelInfo, other.Level())
+	writer.Info("hidden")
+	writer.Warn("json")
+	var line JSONLine
+	assert.Nil(json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal("warn", line.Level)
+	assert.Equal("json", line.Message)
+	assert.Equal("> ", line.Prefix)
+
+	t.Setenv("ALOG_MULTILINE", "maybe")
+	_, err = ConfigFromEnvironment()
+	assert.EqualError(err, `ALOG_MULTILINE: Invalid boolean "maybe".`)
+	// Unknown and invalid variables are skipped, and all of them reported
+	t.Setenv("ALOG_COLOUR", "on")
+	c, err = ConfigFromEnvironment()
+	assert.EqualError(err, `ALOG_COLOUR: Unknown setting "colour". ALOG_MULTILINE: Invalid boolean "maybe".`)
+	assert.Equal(LevelWarn, *c.Level)
+	assert.Nil(c.Multiline)
+	os.WriteFile(path, []byte("colour = on\nnonsense\nterm_width = 100\n"), 0644)
+	c, err = ConfigFromEnvironment()
+	assert.EqualError(err, path+`:1: Unknown setting "colour". `+path+`:2: Expected "key = value". ALOG_COLOUR: Unknown setting "colour". ALOG_MULTILINE: Invalid boolean "maybe".`)
+	assert.Equal(100, c.TermWidth)
+	assert.Equal(LevelWarn, *c.Level)
+
+	// On startup, the valid settings apply despite the others
+	var warnings bytes.Buffer
+	writer = New(&buf, "", 0)
+	configureFromEnvironment(writer, &warnings)
+	assert.Equal(LevelWarn, writer.Level())
+	assert.Equal("alog: ignoring settings: "+err.Error()+"\n", warnings.String())
+}
+
+type countingStringer struct{ count *int }
+
+func (s countingStringer) String() string {
+	*s.count++
+	return "formatted"
+}
+
+func TestFilter(t *testing.T) {
+	assert := assert.New(t)
+	defer SetFilter("")
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	db := writer.Named("filtertest").Named("db")
+	pool := db.Named("pool")
+	client := writer.Named("filtertest").Named("http").Named("client")
+	assert.Nil(SetFilter("warn, filtertest/db=debug,filtertest/http/client=error"))
+	assert.Equal("warn,filtertest/db=debug,filtertest/http/client=error", Filter())
+	var count int
+	writer.Info("hidden %v", countingStringer{&count})
+	client.Warn("hidden %v", countingStringer{&count})
+	assert.Equal(0, count)
+	pool.Debug("pool %v", countingStringer{&count})
+	db.Debug("db")
+	client.Error("client")
+	writer.Warn("warned")
+	assert.Equal(1, count)
+	assert.Equal("pool formatted\ndb\nclient\nwarned\n", buf.String())
+
+	// A level for the caller's package applies to Loggers without a name match
+	buf.Reset()
+	assert.Nil(SetFilter("github.com/tillberg/alog=error,filtertest=debug"))
+	writer.Warn("hidden")
+	db.Debug("named")
+	writer.Error("failed")
+	assert.Equal("named\nfailed\n", buf.String())
+
+	assert.NotNil(SetFilter("db=loud"))
+	assert.NotNil(SetFilter("=debug"))
+	assert.Equal("filtertest=debug,github.com/tillberg/alog=error", Filter())
+	SetLevelForName("filtertest/db", LevelWarn)
+	assert.Equal(LevelWarn, pool.Level())
+	assert.Equal(LevelDebug, client.Level())
+}
+
+func TestTheme(t *testing.T) {
+	assert := assert.New(t)
+	restoreColorRegistries(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "@(muted:>) ", 0)
+	writer.EnableColorTemplate()
+	assert.Equal(string(colorizeCode(nil, ColorRed, "x")), writer.Colorify("@(error:x)"))
+	assert.Equal(string(colorizeCode(nil, ColorGreen, "x")), writer.Colorify("@(success:x)"))
+	assert.Nil(writer.SetTheme("colorblind-safe"))
+	assert.Equal(string(colorizeCode(nil, ColorBright|ColorMagenta, "x")), writer.Colorify("@(error:x)"))
+	assert.Equal(string(colorizeCode(nil, ColorBlue, "x")), writer.Colorify("@(success:x)"))
+	assert.Equal(string(colorizeCode(nil, ColorGreen, "x")), writer.Colorify("@(green:x)"))
+	assert.Nil(writer.SetTheme("monochrome"))
+	assert.Equal("x", writer.Colorify("@(success:x)"))
+	writer.Info("@(number:%d)", 3)
+	assert.Equal(string(colorizeCode(nil, ColorDim, ">"))+" 3\n", buf.String())
+	assert.EqualError(writer.SetTheme("neon"), `Unknown theme "neon".`)
+
+	RegisterTheme("test-theme", Theme{"error": ColorCyan})
+	assert.Contains(ThemeNames(), "test-theme")
+	child := writer.Child("")
+	assert.Nil(writer.SetTheme("test-theme"))
+	assert.Equal(string(colorizeCode(nil, ColorCyan, "x")), writer.Colorify("@(error:x)"))
+	assert.Equal("x", child.Colorify("@(success:x)"))
+	buf.Reset()
+	writer.Err(errors.New("boom"))
+	assert.Contains(buf.String(), string(colorizeCode(nil, ColorCyan, "boom")), "error chains use the theme of the Logger")
+	RegisterTheme("test-theme", Theme{"muted": ColorYellow})
+	buf.Reset()
+	writer.Err(fmt.Errorf("outer: %w", errors.New("inner")))
+	assert.Contains(buf.String(), string(colorizeCode(nil, ColorYellow, "caused by: ")), "error chains style their notes as muted")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			AddAnsiColorCode(fmt.Sprintf("theme_test_%d", i), ColorYellow)
+			writer.Colorify("@(theme_test_0:x)")
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(string(colorizeCode(nil, ColorYellow, "x")), writer.Colorify("@(theme_test_3:x)"))
+}
+
+// The regexp-based implementations that the ANSI scanner replaced, kept to
+// check against and to benchmark.
+var regexpAnsiColor = regexp.MustCompile("\033\\[(\\d+(?:;\\d+)*)m")
+var regexpAnsiColorOrChar = regexp.MustCompile("(\033\\[\\d+m)|.")
+
+func regexpUncolorize(buf []byte) []byte {
+	return regexpAnsiColor.ReplaceAll(buf, bytesEmpty)
+}
+
+func regexpVisibleStringLen(buf []byte) int {
+	return utf8.RuneCount(regexpUncolorize(buf))
+}
+
+func regexpGetActiveAnsiCodes(buf []byte) *ActiveAnsiCodes {
+	var ansiActive ActiveAnsiCodes
+	for _, groups := range regexpAnsiColor.FindAllSubmatch(buf, -1) {
+		code, _ := strconv.ParseInt(string(groups[1]), 10, 32)
+		ansiActive.add(int(code))
+	}
+	return &ansiActive
+}
+
+func regexpTrimString(buf []byte, length int) []byte {
+	if length == 0 {
+		return bytesEmpty
+	}
+	tmp := []byte{}
+	for _, groups := range regexpAnsiColorOrChar.FindAllSubmatch(buf, -1) {
+		tmp = append(tmp, groups[0]...)
+		if len(groups[1]) == 0 {
+			length -= 1
+			if length <= 0 {
+				return tmp
+			}
+		}
+	}
+	return tmp
+}
+
+var ansiScannerInputs = []string{
+	"",
+	"plain text",
+	"\033[31mred\033[39m and \033[1m\033[30mdim\033[0m",
+	"\033[1;31mbold red\033[0m",
+	"\033[31",
+	"\033[m\033[;m\033[31;m\033[x",
+	"\033\033[32mgreen\033[39m\033",
+	"héllo \033[33mwörld\033[39m ✓",
+	"line\none\033[34m\nblue",
+	"\xff\xfe\033[35mbad\033[39m",
+	"\033[99999999999m",
+	"\033[31m\033[39m",
+}
+
+func TestAnsiScanner(t *testing.T) {
+	assert := assert.New(t)
+	for _, input := range ansiScannerInputs {
+		buf := []byte(input)
+		assert.Equal(regexpUncolorize(buf), Uncolorize(buf), "Uncolorize(%q)", input)
+		assert.Equal(regexpUncolorize(buf) == nil, Uncolorize(buf) == nil, "Uncolorize(%q) == nil", input)
+		assert.Equal(regexpVisibleStringLen(buf), VisibleStringLen(buf), "VisibleStringLen(%q)", input)
+		assert.Equal(regexpGetActiveAnsiCodes(buf), getActiveAnsiCodes(buf), "getActiveAnsiCodes(%q)", input)
+		for length := 0; length < 12; length++ {
+			assert.Equal(regexpTrimString(buf, length), trimString(buf, length), "trimString(%q, %d)", input, length)
+		}
+	}
+}
+
+// restoreColorRegistries puts back the color codes and themes registered
+// when it is called once the test ends, so that tests that register their own
+// leave no trace and can be run again.
+func restoreColorRegistries(t *testing.T) {
+	ansiColorCodesMutex.RLock()
+	codes := map[string]ColorCode{}
+	for name, code := range ansiColorCodes {
+		codes[name] = code
+	}
+	ansiColorCodesMutex.RUnlock()
+	themesMutex.RLock()
+	savedThemes := map[string]Theme{}
+	for name, theme := range themes {
+		savedThemes[name] = theme
+	}
+	themesMutex.RUnlock()
+	t.Cleanup(func() {
+		ansiColorCodesMutex.Lock()
+		ansiColorCodes = codes
+		ansiColorCodesMutex.Unlock()
+		themesMutex.Lock()
+		themes = savedThemes
+		themesMutex.Unlock()
+		clearTemplateCache()
+	})
+}
+
+func TestTemplateCache(t *testing.T) {
+	assert := assert.New(t)
+	restoreColorRegistries(t)
+	var buf bytes.Buffer
+	var writer = New(&buf, "", 0)
+	writer.EnableColorTemplate()
+	printf := func(format string) string {
+		buf.Reset()
+		writer.Printf(format + "\n")
+		return strings.TrimSuffix(buf.String(), "\n")
+	}
+	assert.Equal("@(template_test:x)", printf("@(template_test:x)"))
+	AddAnsiColorCode("template_test", ColorMagenta)
+	assert.Equal(string(colorizeCode(nil, ColorMagenta, "x")), printf("@(template_test:x)"))
+	RegisterTheme("template-test", Theme{"template_test": ColorCyan})
+	assert.Nil(writer.SetTheme("template-test"))
+	assert.Equal(string(colorizeCode(nil, ColorCyan, "x")), printf("@(template_test:x)"))
+	RegisterTheme("template-test", Theme{"template_test": ColorBlue})
+	assert.Equal(string(colorizeCode(nil, ColorBlue, "x")), printf("@(template_test:x)"))
+	writer.SetColorTemplateRegexp(regexp.MustCompile("<([a-z_]+)(:([^>]*?))?>"))
+	assert.Equal(string(colorizeCode(nil, ColorBlue, "x"))+" @(template_test:x)", printf("<template_test:x> @(template_test:x)"))
+	for i := 0; i < maxCachedTemplates+10; i++ {
+		printf(fmt.Sprintf("<red:%d>", i))
+	}
+	assert.LessOrEqual(len(templateCache), maxCachedTemplates)
+
+	// Colorify is for one-off strings, which aren't cached
+	clearTemplateCache()
+	assert.Equal(string(colorizeCode(nil, ColorBlue, "x")), writer.Colorify("<template_test:x>"))
+	assert.Empty(templateCache)
+}
+
+var benchmarkLine = []byte("\033[1m\033[30m2024-01-02T03:04:05\033[0m building \033[32mpackage\033[39m in \033[33m1.5s\033[39m with 12 workers")
+
+func BenchmarkPrintf(b *testing.B) {
+	var writer = New(io.Discard, "", 0)
+	writer.EnableColorTemplate()
+	for i := 0; i < b.N; i++ {
+		writer.Printf("@(error:failed) after @(number:%d) attempts: @(muted:%s)\n", i, "timeout")
+	}
+}
+
+func BenchmarkProcessColorTemplates(b *testing.B) {
+	rgx := DefaultLogger.getColorTemplateRegexp()
+	for i := 0; i < b.N; i++ {
+		processColorTemplates(rgx, "", []byte("@(error:failed) after @(number:%d) attempts: @(muted:%s)\n"))
+	}
+}
+
+func BenchmarkCompileTemplate(b *testing.B) {
+	rgx := DefaultLogger.getColorTemplateRegexp()
+	for i := 0; i < b.N; i++ {
+		compileTemplate(rgx, "", "@(error:failed) after @(number:%d) attempts: @(muted:%s)\n")
+	}
+}
+
+func BenchmarkVisibleStringLen(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		VisibleStringLen(benchmarkLine)
+	}
+}
+
+func BenchmarkVisibleStringLenRegexp(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		regexpVisibleStringLen(benchmarkLine)
+	}
+}
+
+func BenchmarkGetActiveAnsiCodes(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		getActiveAnsiCodes(benchmarkLine)
+	}
+}
+
+func BenchmarkGetActiveAnsiCodesRegexp(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		regexpGetActiveAnsiCodes(benchmarkLine)
+	}
+}
+
+func BenchmarkUncolorize(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Uncolorize(benchmarkLine)
+	}
+}
+
+func BenchmarkUncolorizeRegexp(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		regexpUncolorize(benchmarkLine)
+	}
+}
+
+func BenchmarkTrimString(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		trimString(benchmarkLine, 40)
+	}
+}
+
+func BenchmarkTrimStringRegexp(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		regexpTrimString(benchmarkLine, 40)
+	}
+}
+
 // XXX To make this really work, we'd need to stub out time.Now() in log.go.
 // func TestPrefix(t *testing.T) {
 // 	assert := assert.New(t)
@@ -0,0 +1,107 @@
+package alog
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The colors chosen from by HashColor; black and white are left out, as one
+// or the other is usually the terminal's background.
+var hashColors = []ColorCode{
+	ColorRed, ColorGreen, ColorYellow, ColorBlue, ColorMagenta, ColorCyan,
+	ColorBright | ColorRed, ColorBright | ColorGreen, ColorBright | ColorYellow,
+	ColorBright | ColorBlue, ColorBright | ColorMagenta, ColorBright | ColorCyan,
+}
+
+// HashColor returns a color derived from a hash of s, so that the same text
+// always gets the same color. The @(hash:text) color template uses it to
+// color text by its content.
+func HashColor(s string) ColorCode {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return hashColors[h.Sum32()%uint32(len(hashColors))]
+}
+
+// muxLeaf is a Logger handed out by a Mux (or one of its sinks, for a tee),
+// along with the prefix that it had before the Mux added the name column.
+type muxLeaf struct {
+	logger     *Logger
+	basePrefix string
+}
+
+// A Mux hands out named Loggers for interleaving the output of several
+// sources, like docker-compose does. Each Logger is a child of the Mux's
+// Logger (see Child) whose prefix adds a column with its name, colored by
+// HashColor and padded to the length of the longest name so far, so that the
+// messages of all sources line up.
+type Mux struct {
+	mutex   sync.Mutex
+	parent  *Logger
+	loggers map[string]*Logger
+	leaves  map[string][]muxLeaf
+	width   int
+}
+
+// NewMux returns a Mux whose Loggers are children of l.
+func NewMux(l *Logger) *Mux {
+	return &Mux{parent: l, loggers: map[string]*Logger{}, leaves: map[string][]muxLeaf{}}
+}
+
+// muxPrefix returns the name column for name: the name padded to width,
+// followed by a separator, all in the name's color.
+func muxPrefix(name string, width int) string {
+	column := name + strings.Repeat(" ", width-utf8.RuneCountInString(name)) + " |"
+	return string(colorizeCode(nil, HashColor(name), column)) + " "
+}
+
+// Logger returns the Logger for the source called name, creating it the first
+// time. If name is longer than any before it, the name columns of all of the
+// Mux's Loggers are widened to match. The Logger is named as by Named, so its
+// level threshold can be configured by name.
+func (m *Mux) Logger(name string) *Logger {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if l, ok := m.loggers[name]; ok {
+		return l
+	}
+	l := m.parent.Named(name)
+	m.loggers[name] = l
+	var leaves []muxLeaf
+	for _, leaf := range l.leafLoggers() {
+		leaves = append(leaves, muxLeaf{logger: leaf, basePrefix: leaf.Prefix()})
+	}
+	m.leaves[name] = leaves
+	if width := utf8.RuneCountInString(name); width > m.width {
+		m.width = width
+		for name, leaves := range m.leaves {
+			m.setPrefixes(name, leaves)
+		}
+	} else {
+		m.setPrefixes(name, leaves)
+	}
+	return l
+}
+
+func (m *Mux) setPrefixes(name string, leaves []muxLeaf) {
+	for _, leaf := range leaves {
+		leaf.logger.SetPrefix(leaf.basePrefix + muxPrefix(name, m.width))
+	}
+}
+
+// leafLoggers returns l, or for a tee, the Loggers at the ends of its sinks.
+func (l *Logger) leafLoggers() []*Logger {
+	ws := getWriterState(l.out)
+	ws.lock()
+	sinks := append([]*Logger{}, l.sinks...)
+	ws.unlock()
+	if len(sinks) == 0 {
+		return []*Logger{l}
+	}
+	var leaves []*Logger
+	for _, sink := range sinks {
+		leaves = append(leaves, sink.leafLoggers()...)
+	}
+	return leaves
+}
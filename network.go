@@ -0,0 +1,345 @@
+package alog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tillberg/alog/internal/linebuf"
+)
+
+var errNetworkWriterClosed = errors.New("Attempted to write to closed NetworkWriter.")
+
+// NetworkOptions configures a NetworkWriter.
+type NetworkOptions struct {
+	Network string // "tcp" or "unix"
+	Address string
+	// JSON sends each line as a JSONLine object rather than as plain text.
+	JSON bool
+	// SpoolPath is the file that lines are kept in while disconnected. If it
+	// is empty, they are kept in memory instead. Lines left in the spool file
+	// by a previous run are sent once connected.
+	SpoolPath string
+	// MaxSpoolSize is the most that the spool may hold, in bytes; lines that
+	// don't fit are dropped, and a line saying how many were dropped is sent
+	// after the spool. It defaults to 64 MiB.
+	MaxSpoolSize int64
+	// MinBackoff and MaxBackoff bound the delay between attempts to connect,
+	// which doubles after each failure. They default to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// WriteTimeout limits each write to the connection; a write that times out
+	// is treated as a disconnection. It defaults to 10s.
+	WriteTimeout time.Duration
+}
+
+// A NetworkWriter streams completed lines to a log collector over TCP or a
+// unix socket, as plain text (with ANSI escapes removed) or as JSON lines.
+// It is an alog.LineWriter, so use it as the output of a Logger, or as one of
+// the sinks of a tee (see NewTee) to ship lines alongside terminal output.
+// Plain text written to it is sent a line at a time at LevelInfo.
+//
+// The NetworkWriter connects in the background. While it isn't connected,
+// lines are kept in a spool, which is sent in order once the connection is
+// (re)established, before any new lines. Lines may be sent twice if the
+// connection fails partway through sending them. A NetworkWriter never
+// blocks for longer than a write to the connection can take, so logging
+// continues while the collector is down.
+type NetworkWriter struct {
+	mutex        sync.Mutex
+	options      NetworkOptions
+	conn         net.Conn
+	reconnecting bool
+	spoolFile    *os.File // nil for an in-memory spool
+	spool        []byte
+	spoolStart   int64 // offset of the first line in the spool that hasn't been sent
+	spoolEnd     int64
+	droppedLines int
+	lines        linebuf.Buffer
+	closed       bool
+	done         chan struct{}
+}
+
+// NewNetworkWriter returns a NetworkWriter for the collector described by
+// options, which starts connecting in the background. It only returns an
+// error if the spool file can't be opened.
+func NewNetworkWriter(options NetworkOptions) (*NetworkWriter, error) {
+	if options.MaxSpoolSize == 0 {
+		options.MaxSpoolSize = 64 << 20
+	}
+	if options.MinBackoff == 0 {
+		options.MinBackoff = 100 * time.Millisecond
+	}
+	if options.MaxBackoff == 0 {
+		options.MaxBackoff = 30 * time.Second
+	}
+	if options.WriteTimeout == 0 {
+		options.WriteTimeout = 10 * time.Second
+	}
+	w := &NetworkWriter{options: options, done: make(chan struct{})}
+	if options.SpoolPath != "" {
+		f, err := os.OpenFile(options.SpoolPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		w.spoolFile = f
+		w.spoolEnd = info.Size()
+	}
+	w.reconnecting = true
+	go w.reconnect()
+	return w, nil
+}
+
+// encode returns line in the form that it's sent in, including a newline.
+func (w *NetworkWriter) encode(line *Line) []byte {
+	if w.options.JSON {
+		return encodeJSONLine(line)
+	}
+	return append(Uncolorize(line.Bytes()), '\n')
+}
+
+// sendLocked sends a line, or spools it if there's no connection, or if
+// earlier lines are still waiting in the spool.
+func (w *NetworkWriter) sendLocked(line *Line) error {
+	if w.closed {
+		return errNetworkWriterClosed
+	}
+	record := w.encode(line)
+	if w.conn != nil && w.spoolStart == w.spoolEnd {
+		w.conn.SetWriteDeadline(time.Now().Add(w.options.WriteTimeout))
+		if _, err := w.conn.Write(record); err == nil {
+			return nil
+		}
+		w.disconnectLocked(w.conn)
+	}
+	return w.spoolLocked(record)
+}
+
+// spoolLocked adds a line to the end of the spool, or counts it as dropped if
+// the spool is full.
+func (w *NetworkWriter) spoolLocked(record []byte) error {
+	if w.spoolEnd+int64(len(record)) > w.options.MaxSpoolSize {
+		w.droppedLines++
+		return nil
+	}
+	if w.spoolFile != nil {
+		if _, err := w.spoolFile.WriteAt(record, w.spoolEnd); err != nil {
+			w.droppedLines++
+			return err
+		}
+	} else {
+		w.spool = append(w.spool, record...)
+	}
+	w.spoolEnd += int64(len(record))
+	return nil
+}
+
+// readSpoolLocked copies the next chunk of the spool to send into buf,
+// starting at spoolStart and ending after the last complete line that fits.
+func (w *NetworkWriter) readSpoolLocked(buf []byte) ([]byte, error) {
+	n := int64(len(buf))
+	if w.spoolEnd-w.spoolStart < n {
+		n = w.spoolEnd - w.spoolStart
+	}
+	var chunk []byte
+	if w.spoolFile != nil {
+		read, err := w.spoolFile.ReadAt(buf[:n], w.spoolStart)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		chunk = buf[:read]
+	} else {
+		chunk = buf[:copy(buf, w.spool[w.spoolStart:w.spoolStart+n])]
+	}
+	if index := bytes.LastIndexByte(chunk, '\n'); index != -1 {
+		chunk = chunk[:index+1]
+	}
+	return chunk, nil
+}
+
+// replay sends the contents of the spool over conn, followed by a line about
+// any lines that were dropped, and then makes conn the connection. Lines
+// logged meanwhile are added to the spool and sent in turn, so the lock is
+// only held to read each chunk, never while writing to conn.
+func (w *NetworkWriter) replay(conn net.Conn) error {
+	buf := make([]byte, 64*1024)
+	for {
+		w.mutex.Lock()
+		if w.closed {
+			w.mutex.Unlock()
+			return errNetworkWriterClosed
+		}
+		if w.spoolStart >= w.spoolEnd && w.droppedLines == 0 {
+			w.spoolStart = 0
+			w.spoolEnd = 0
+			w.spool = w.spool[:0]
+			if w.spoolFile != nil {
+				w.spoolFile.Truncate(0)
+			}
+			w.conn = conn
+			w.reconnecting = false
+			w.mutex.Unlock()
+			return nil
+		}
+		var chunk []byte
+		var dropped int
+		var err error
+		if w.spoolStart < w.spoolEnd {
+			chunk, err = w.readSpoolLocked(buf)
+			if err == nil && len(chunk) == 0 {
+				// The spool file is shorter than expected
+				w.spoolStart = w.spoolEnd
+			}
+		} else {
+			dropped = w.droppedLines
+			w.droppedLines = 0
+			notice := plural(dropped, "line") + " dropped while disconnected"
+			chunk = w.encode(&Line{Time: time.Now(), Level: LevelWarn, Message: []byte(notice)})
+		}
+		w.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		conn.SetWriteDeadline(time.Now().Add(w.options.WriteTimeout))
+		n, err := conn.Write(chunk)
+		w.mutex.Lock()
+		if dropped > 0 {
+			if err != nil {
+				w.droppedLines += dropped
+			}
+		} else if err != nil {
+			// Resend any line that was only partly sent
+			w.spoolStart += int64(bytes.LastIndexByte(chunk[:n], '\n') + 1)
+		} else {
+			w.spoolStart += int64(n)
+		}
+		w.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextBackoff returns how long to wait after another failed attempt to
+// connect, given the last delay, or 0 before the first: min, and then twice
+// the last delay, up to max.
+func nextBackoff(delay time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if delay == 0 {
+		return min
+	}
+	if delay *= 2; delay > max {
+		return max
+	}
+	return delay
+}
+
+// reconnect connects to the collector, retrying with exponential backoff,
+// and sends the spool once connected.
+func (w *NetworkWriter) reconnect() {
+	var delay time.Duration
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = nextBackoff(delay, w.options.MinBackoff, w.options.MaxBackoff)
+		conn, err := net.DialTimeout(w.options.Network, w.options.Address, w.options.WriteTimeout)
+		if err != nil {
+			continue
+		}
+		if err := w.replay(conn); err != nil {
+			conn.Close()
+			if err == errNetworkWriterClosed {
+				return
+			}
+			continue
+		}
+		go w.watch(conn)
+		return
+	}
+}
+
+// watch notices when the collector closes the connection, so that lines
+// logged afterwards are spooled rather than lost. Nothing is expected to be
+// read from the connection.
+func (w *NetworkWriter) watch(conn net.Conn) {
+	io.Copy(io.Discard, conn)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.disconnectLocked(conn)
+}
+
+// disconnectLocked closes conn, if it's the current connection, and starts
+// reconnecting.
+func (w *NetworkWriter) disconnectLocked(conn net.Conn) {
+	if w.conn != conn {
+		return
+	}
+	conn.Close()
+	w.conn = nil
+	if !w.closed && !w.reconnecting {
+		w.reconnecting = true
+		go w.reconnect()
+	}
+}
+
+// WriteLine implements LineWriter.
+func (w *NetworkWriter) WriteLine(line *Line) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.sendLocked(line)
+}
+
+// Write implements io.Writer.
+func (w *NetworkWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(p), w.lines.Add(p, w.sendText)
+}
+
+// sendText sends a line of plain text written to w at LevelInfo.
+func (w *NetworkWriter) sendText(text []byte) error {
+	return w.sendLocked(&Line{Time: time.Now(), Message: text})
+}
+
+// Connected returns whether the NetworkWriter is currently connected to the
+// collector and has sent everything that was spooled.
+func (w *NetworkWriter) Connected() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.conn != nil
+}
+
+// Close sends any unfinished line written with Write and closes the
+// connection. Anything left in a spool file is sent by the next
+// NetworkWriter to use it.
+func (w *NetworkWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	err := w.lines.Flush(w.sendText)
+	w.closed = true
+	close(w.done)
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	if w.spoolFile != nil {
+		if closeErr := w.spoolFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package alog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Recover, when deferred, catches a panic in the calling goroutine, finalizes
+// the temp lines of every writer so that nothing is drawn over the trace, logs
+// the panic value and stack trace through DefaultLogger, and then panics again
+// with the same value.
+func Recover() {
+	if r := recover(); r != nil {
+		logPanic(r)
+		panic(r)
+	}
+}
+
+// RecoverAndExit is like Recover, but exits the process with the given code
+// instead of panicking again.
+func RecoverAndExit(code int) {
+	if r := recover(); r != nil {
+		logPanic(r)
+		osExit(code)
+	}
+}
+
+// finalizeTempLines flushes the temp lines of every writer as permanent
+// lines. This leaves the cursor at the start of an empty line below any
+// multiline temp region.
+func finalizeTempLines() {
+	mutexGlobal.RLock()
+	states := make([]*WriterState, 0, len(writers))
+	for _, ws := range writers {
+		states = append(states, ws)
+	}
+	mutexGlobal.RUnlock()
+	for _, ws := range states {
+		ws.lock()
+		ws.flushAll()
+		ws.unlock()
+	}
+}
+
+// panicStack returns the stack of a goroutine that is panicking, omitting
+// the frames for recovery and for raising the panic itself.
+func panicStack() []StackFrame {
+	frames := CaptureStack(1)
+	for i, frame := range frames {
+		if frame.Function == "runtime.gopanic" {
+			frames = frames[i+1:]
+			break
+		}
+	}
+	for len(frames) > 0 && (strings.HasPrefix(frames[0].Function, "runtime.") || isAlogFrame(frames[0])) {
+		frames = frames[1:]
+	}
+	return frames
+}
+
+func logPanic(r interface{}) {
+	frames := panicStack()
+	finalizeTempLines()
+	l := DefaultLogger
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	var buf []byte
+	buf = colorize(buf, l.getTheme(), "error", "panic: ")
+	if err, ok := r.(error); ok {
+		buf = appendErrorChain(buf, l.getTheme(), err, l.getStackTraceDepth())
+	} else {
+		buf = append(buf, fmt.Sprint(r)...)
+	}
+	buf = append(buf, '\n')
+	l.flushInt()
+	l.raiseLevel(LevelError)
+	l.intOutput(2, l.appendStackTrace(buf, frames), true)
+	flushAsyncWriters()
+}
@@ -32,6 +32,8 @@ func NewRotatingLogger(path string, loggerInt PrintLogger) (*RotatingLogger, err
 		l.size = stat.Size()
 	}
 	l.Logger = New(l, "@(dim:{isodate}) ", 0)
+	// Temp lines would only write redraw escapes into the file
+	l.Logger.HidePartialLines()
 	err = l.openfile()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,202 @@
+package alog
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A StackFrame is a single function call in a captured stack trace.
+type StackFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+type goroutineStack struct {
+	header string
+	frames []StackFrame
+}
+
+var alogPackagePath = reflect.TypeOf(Logger{}).PkgPath()
+
+// isAlogFrame reports whether frame belongs to alog itself (as opposed to
+// code calling into alog, including alog's own tests).
+func isAlogFrame(frame StackFrame) bool {
+	return strings.HasPrefix(frame.Function, alogPackagePath+".") && !strings.HasSuffix(frame.File, "_test.go")
+}
+
+// CaptureStack returns the call stack of the current goroutine, starting skip
+// frames above the caller of CaptureStack. Any alog frames at the top of the
+// stack are omitted, as is the runtime.goexit frame at the bottom.
+func CaptureStack(skip int) []StackFrame {
+	pcs := make([]uintptr, 64)
+	for {
+		n := runtime.Callers(skip+2, pcs)
+		if n < len(pcs) {
+			pcs = pcs[:n]
+			break
+		}
+		pcs = make([]uintptr, 2*len(pcs))
+	}
+	var stack []StackFrame
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "runtime.goexit" {
+			stack = append(stack, StackFrame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	for len(stack) > 0 && isAlogFrame(stack[0]) {
+		stack = stack[1:]
+	}
+	return stack
+}
+
+// captureOtherGoroutines returns the stacks of every goroutine except the
+// current one, parsed from the output of runtime.Stack.
+func captureOtherGoroutines() []goroutineStack {
+	size := 1 << 16
+	var buf []byte
+	for {
+		buf = make([]byte, size)
+		n := runtime.Stack(buf, true)
+		if n < size {
+			buf = buf[:n]
+			break
+		}
+		size *= 2
+	}
+	stacks := parseGoroutineStacks(string(buf))
+	if len(stacks) > 0 {
+		// The first goroutine is always the current one
+		stacks = stacks[1:]
+	}
+	return stacks
+}
+
+// parseGoroutineStacks parses the text format written by runtime.Stack.
+func parseGoroutineStacks(text string) []goroutineStack {
+	var stacks []goroutineStack
+	for _, block := range strings.Split(strings.TrimSpace(text), "\n\n") {
+		lines := strings.Split(block, "\n")
+		stack := goroutineStack{header: strings.TrimSuffix(lines[0], ":")}
+		for i := 1; i+1 < len(lines); i += 2 {
+			function := lines[i]
+			if !strings.HasPrefix(function, "created by ") {
+				if index := strings.LastIndexByte(function, '('); index > 0 {
+					function = function[:index]
+				}
+			}
+			location := strings.TrimSpace(lines[i+1])
+			if index := strings.LastIndex(location, " +0x"); index != -1 {
+				location = location[:index]
+			}
+			frame := StackFrame{Function: function, File: location}
+			if index := strings.LastIndexByte(location, ':'); index != -1 {
+				if line, err := strconv.Atoi(location[index+1:]); err == nil {
+					frame.File = location[:index]
+					frame.Line = line
+				}
+			}
+			stack.frames = append(stack.frames, frame)
+		}
+		stacks = append(stacks, stack)
+	}
+	return stacks
+}
+
+// colorize wraps s in the ANSI escapes for the named color template code, in
+// the named theme (see Logger.getTheme). These are stripped later on if color
+// is disabled for the Logger.
+func colorize(buf []byte, theme string, name string, s string) []byte {
+	colorCode, _ := lookupColorCode(theme, name)
+	return colorizeCode(buf, colorCode, s)
+}
+
+// colorizeCode wraps s in the ANSI escapes for colorCode.
+func colorizeCode(buf []byte, colorCode ColorCode, s string) []byte {
+	var ansiActive ActiveAnsiCodes
+	for _, code := range colorCode.GetAnsiCodes() {
+		ansiActive.add(code)
+		buf = append(buf, ansiEscapeBytes(code)...)
+	}
+	buf = append(buf, s...)
+	return append(buf, ansiActive.getResetBytes()...)
+}
+
+// appendStackFrames renders frames as two lines each, the function name in
+// bold and the indented file:line dimmed, stopping after maxDepth frames if
+// maxDepth is positive.
+func appendStackFrames(buf []byte, theme string, frames []StackFrame, indent string, maxDepth int) []byte {
+	for i, frame := range frames {
+		if maxDepth > 0 && i == maxDepth {
+			buf = append(buf, indent...)
+			buf = colorize(buf, theme, "muted", "... "+strconv.Itoa(len(frames)-i)+" more frames")
+			buf = append(buf, '\n')
+			break
+		}
+		buf = append(buf, indent...)
+		buf = colorize(buf, theme, "accent", frame.Function)
+		buf = append(buf, '\n')
+		buf = append(buf, indent...)
+		buf = append(buf, "    "...)
+		buf = colorize(buf, theme, "muted", frame.File+":"+strconv.Itoa(frame.Line))
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+func (l *Logger) getStackTraceDepth() int {
+	if l.stackTraceDepth != 0 {
+		return l.stackTraceDepth
+	}
+	return DefaultLogger.stackTraceDepth
+}
+
+func (l *Logger) isStackTraceAllGoroutinesEnabled() bool {
+	return isTrueDefaulted(l.stackTraceAllGoroutines, DefaultLogger.stackTraceAllGoroutines)
+}
+
+// appendStackTrace renders frames followed, if enabled for this Logger, by
+// the stacks of all other goroutines.
+func (l *Logger) appendStackTrace(buf []byte, frames []StackFrame) []byte {
+	maxDepth := l.getStackTraceDepth()
+	theme := l.getTheme()
+	buf = appendStackFrames(buf, theme, frames, "", maxDepth)
+	if l.isStackTraceAllGoroutinesEnabled() {
+		for _, stack := range captureOtherGoroutines() {
+			buf = append(buf, '\n')
+			buf = colorize(buf, theme, "accent", stack.header+":")
+			buf = append(buf, '\n')
+			buf = appendStackFrames(buf, theme, stack.frames, "  ", maxDepth)
+		}
+	}
+	return buf
+}
+
+// SetStackTraceDepth sets the maximum number of frames printed per goroutine
+// in stack traces written by Bail. A depth of 0 falls back to the setting of
+// DefaultLogger, for which 0 means unlimited.
+func (l *Logger) SetStackTraceDepth(depth int) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.stackTraceDepth = depth
+}
+
+// SetStackTraceAllGoroutines sets whether stack traces written by Bail also
+// include the stacks of all other goroutines.
+func (l *Logger) SetStackTraceAllGoroutines(flag bool) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.stackTraceAllGoroutines = boolPointer(flag)
+}
+
+func SetStackTraceDepth(depth int)         { DefaultLogger.SetStackTraceDepth(depth) }
+func SetStackTraceAllGoroutines(flag bool) { DefaultLogger.SetStackTraceAllGoroutines(flag) }
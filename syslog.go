@@ -0,0 +1,324 @@
+package alog
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tillberg/alog/internal/linebuf"
+)
+
+// SyslogFormat selects the message format used by a SyslogWriter.
+type SyslogFormat int
+
+const (
+	SyslogRFC5424 SyslogFormat = iota // <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+	SyslogRFC3164                     // <PRI>Mmm dd hh:mm:ss HOSTNAME APP-NAME[PROCID]: MSG
+)
+
+// Syslog facilities, for SyslogOptions.Facility. The kernel facility, 0, is
+// reserved for the kernel.
+const (
+	SyslogUser   = 1
+	SyslogDaemon = 3
+	SyslogAuth   = 4
+	SyslogLocal0 = 16
+	SyslogLocal1 = 17
+	SyslogLocal2 = 18
+	SyslogLocal3 = 19
+	SyslogLocal4 = 20
+	SyslogLocal5 = 21
+	SyslogLocal6 = 22
+	SyslogLocal7 = 23
+)
+
+// The sockets tried, in order, when no address is given.
+var syslogLocalAddresses = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+var errSyslogWriterClosed = errors.New("Attempted to write to closed SyslogWriter.")
+var errSyslogDisconnected = errors.New("Not connected to syslog; waiting to reconnect.")
+
+// SyslogOptions configures a SyslogWriter.
+type SyslogOptions struct {
+	// Network is "unixgram" or "unix" for a local socket, or "udp" or "tcp".
+	// If Network is empty, Address is a local socket of either kind, and if
+	// both are empty, the system's syslog socket is used.
+	Network string
+	Address string
+	Format  SyslogFormat
+	// Facility defaults to SyslogUser.
+	Facility int
+	// Hostname defaults to os.Hostname(), and AppName to the base name of the
+	// program.
+	Hostname string
+	AppName  string
+	// Timeout limits each attempt to connect and each write. It defaults to
+	// 5s.
+	Timeout time.Duration
+	// MinBackoff and MaxBackoff bound the delay after a failed attempt to
+	// connect before the next, which doubles after each failure. They default
+	// to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// A SyslogWriter sends completed lines to syslog, with ANSI escapes removed.
+// It is an alog.LineWriter, so use it as the output of a Logger (normally
+// with no prefix and no date flags, as syslog records its own timestamp);
+// the level of each line selects its syslog severity. Plain text written to
+// it is sent a line at a time with the severity for LevelInfo.
+//
+// Messages are sent over a unix datagram socket, UDP, or a stream socket or
+// TCP using the octet-counting framing of RFC 6587. If sending fails, the
+// SyslogWriter reconnects and tries once more; if the connection can't be
+// reestablished, the line is lost and the error is returned. Lines logged
+// while waiting to connect again, with exponential backoff, are dropped
+// without blocking, and once reconnected, a line says how many were dropped.
+type SyslogWriter struct {
+	mutex   sync.Mutex
+	options SyslogOptions
+	network string
+	address string
+	pid     int
+	conn    net.Conn
+	lines   linebuf.Buffer
+	closed  bool
+	msg     []byte
+	framed  []byte
+	dial    func(network string, address string) (net.Conn, error)
+	backoff time.Duration
+	retryAt time.Time // when to next try to connect, while disconnected
+	dropped int       // lines dropped while disconnected
+}
+
+// NewSyslogWriter returns a SyslogWriter that is connected to the syslog
+// server described by options.
+func NewSyslogWriter(options SyslogOptions) (*SyslogWriter, error) {
+	if options.Facility == 0 {
+		options.Facility = SyslogUser
+	}
+	if options.Hostname == "" {
+		options.Hostname, _ = os.Hostname()
+		if options.Hostname == "" {
+			options.Hostname = "-"
+		}
+	}
+	if options.AppName == "" {
+		options.AppName = filepath.Base(os.Args[0])
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.MinBackoff == 0 {
+		options.MinBackoff = 100 * time.Millisecond
+	}
+	if options.MaxBackoff == 0 {
+		options.MaxBackoff = 30 * time.Second
+	}
+	w := &SyslogWriter{options: options, network: options.Network, address: options.Address, pid: os.Getpid()}
+	w.dial = func(network string, address string) (net.Conn, error) {
+		return net.DialTimeout(network, address, w.options.Timeout)
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// connect (re)establishes the connection to the syslog server.
+func (w *SyslogWriter) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	if w.options.Network == "" {
+		addresses := syslogLocalAddresses
+		if w.options.Address != "" {
+			addresses = []string{w.options.Address}
+		}
+		var err error
+		for _, address := range addresses {
+			for _, network := range []string{"unixgram", "unix"} {
+				var conn net.Conn
+				conn, err = w.dial(network, address)
+				if err == nil {
+					w.conn = conn
+					w.network = network
+					w.address = address
+					return nil
+				}
+			}
+		}
+		return err
+	}
+	conn, err := w.dial(w.network, w.address)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// syslogSeverity returns the syslog severity for level.
+func syslogSeverity(level Level) int {
+	switch {
+	case level >= LevelError:
+		return 3 // err
+	case level >= LevelWarn:
+		return 4 // warning
+	case level >= LevelInfo:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+// appendSyslogName appends s, or "-" if s is empty, with any spaces replaced,
+// as RFC 5424 header fields can't contain them.
+func appendSyslogName(buf []byte, s string) []byte {
+	if s == "" {
+		return append(buf, '-')
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			buf = append(buf, '_')
+		} else {
+			buf = append(buf, s[i])
+		}
+	}
+	return buf
+}
+
+// format renders a message in the SyslogWriter's format into w.msg.
+func (w *SyslogWriter) format(t time.Time, level Level, text []byte) {
+	pri := w.options.Facility*8 + syslogSeverity(level)
+	buf := append(w.msg[:0], '<')
+	buf = strconv.AppendInt(buf, int64(pri), 10)
+	buf = append(buf, '>')
+	if w.options.Format == SyslogRFC3164 {
+		buf = t.AppendFormat(buf, time.Stamp)
+		buf = append(buf, ' ')
+		buf = appendSyslogName(buf, w.options.Hostname)
+		buf = append(buf, ' ')
+		buf = appendSyslogName(buf, w.options.AppName)
+		buf = append(buf, '[')
+		buf = strconv.AppendInt(buf, int64(w.pid), 10)
+		buf = append(buf, "]: "...)
+	} else {
+		buf = append(buf, "1 "...)
+		buf = t.AppendFormat(buf, "2006-01-02T15:04:05.000000Z07:00")
+		buf = append(buf, ' ')
+		buf = appendSyslogName(buf, w.options.Hostname)
+		buf = append(buf, ' ')
+		buf = appendSyslogName(buf, w.options.AppName)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, int64(w.pid), 10)
+		buf = append(buf, " - - "...)
+	}
+	w.msg = append(buf, Uncolorize(text)...)
+}
+
+// reconnect connects to the syslog server, unless an attempt failed too
+// recently, in which case it waits out the backoff without dialing.
+func (w *SyslogWriter) reconnect() error {
+	now := time.Now()
+	if now.Before(w.retryAt) {
+		return errSyslogDisconnected
+	}
+	if err := w.connect(); err != nil {
+		w.backoff = nextBackoff(w.backoff, w.options.MinBackoff, w.options.MaxBackoff)
+		w.retryAt = now.Add(w.backoff)
+		return err
+	}
+	w.backoff = 0
+	return nil
+}
+
+// send sends the message in w.msg, reconnecting and retrying once on failure.
+func (w *SyslogWriter) send() error {
+	msg := w.msg
+	if w.network != "unixgram" && !strings.HasPrefix(w.network, "udp") {
+		w.framed = strconv.AppendInt(w.framed[:0], int64(len(w.msg)), 10)
+		w.framed = append(w.framed, ' ')
+		w.framed = append(w.framed, w.msg...)
+		msg = w.framed
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil || attempt > 0 {
+			if err = w.reconnect(); err != nil {
+				return err
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(w.options.Timeout))
+		if _, err = w.conn.Write(msg); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *SyslogWriter) sendLocked(t time.Time, level Level, text []byte) error {
+	if w.closed {
+		return errSyslogWriterClosed
+	}
+	if w.dropped > 0 {
+		w.format(time.Now(), LevelWarn, []byte(plural(w.dropped, "line")+" dropped while disconnected"))
+		if err := w.send(); err != nil {
+			w.dropped++
+			return err
+		}
+		w.dropped = 0
+	}
+	w.format(t, level, text)
+	if err := w.send(); err != nil {
+		w.dropped++
+		return err
+	}
+	return nil
+}
+
+// WriteLine implements LineWriter.
+func (w *SyslogWriter) WriteLine(line *Line) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.sendLocked(line.Time, line.Level, line.Bytes())
+}
+
+// Write implements io.Writer.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(p), w.lines.Add(p, w.sendText)
+}
+
+// sendText sends a line of plain text written to w at LevelInfo.
+func (w *SyslogWriter) sendText(text []byte) error {
+	return w.sendLocked(time.Now(), LevelInfo, text)
+}
+
+// Close sends any unfinished line written with Write and closes the
+// connection.
+func (w *SyslogWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	err := w.lines.Flush(w.sendText)
+	w.closed = true
+	if w.conn != nil {
+		if closeErr := w.conn.Close(); err == nil {
+			err = closeErr
+		}
+		w.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package alog
+
+// teeOutput is the output of a tee Logger. Nothing is ever written to it; it
+// just gives each tee a WriterState of its own, which is kept here rather
+// than in writers so that it goes away along with the tee.
+type teeOutput struct {
+	ws *WriterState
+}
+
+func (t *teeOutput) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// NewTee creates a Logger that passes everything written to it on to each of
+// the sink Loggers, which apply their own prefix, flags and color, partial
+// line and other settings. For example, one sink might write to the terminal
+// with colors, temp lines and an {elapsed} prefix, while another writes to a
+// RotatingLogger with no colors, no partial lines and an {isodate} prefix;
+// the latter then only sees each line once it is complete. The tee's own
+// formatting settings are unused, except for color templates, which are
+// applied before the text is passed on. Closing the tee closes its sinks.
+func NewTee(sinks ...*Logger) *Logger {
+	l := New(&teeOutput{ws: newWriterState()}, "", 0)
+	l.sinks = sinks
+	return l
+}
+
+// AddSink adds a Logger to the sinks of a tee created with NewTee.
+func (l *Logger) AddSink(sink *Logger) {
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.sinks = append(l.sinks, sink)
+}
+
+// eachSink calls f for each of the sinks of l with the sink's lock held.
+func (l *Logger) eachSink(f func(sink *Logger)) {
+	for _, sink := range l.sinks {
+		ws := getWriterState(sink.out)
+		ws.lock()
+		f(sink)
+		ws.unlock()
+	}
+}
+
+// forward passes s on to each of the sinks of l, along with the level and
+// fields of the current call. Each sink tracks its own line level and fields
+// from then on.
+func (l *Logger) forward(calldepth int, s []byte) {
+	partial := false
+	l.eachSink(func(sink *Logger) {
+		sink.startLevel(l.lineLevel)
+		sink.addFields(l.lineFields)
+		// +3 for the sink's intOutput, this closure and eachSink
+		sink.intOutput(calldepth+3, s, true)
+		partial = partial || len(sink.buf) > 0
+	})
+	l.lineLevel = LevelInfo
+	l.lineFields = nil
+	if !partial {
+		l.endLineContext()
+	}
+}
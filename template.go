@@ -0,0 +1,55 @@
+package alog
+
+import (
+	"regexp"
+	"sync"
+)
+
+// The most format strings kept compiled. The cache is emptied when it is
+// full, so that formats built at run time can't make it grow without bound.
+const maxCachedTemplates = 1024
+
+type templateKey struct {
+	regexp *regexp.Regexp
+	theme  string
+	format string
+}
+
+var templateCacheMutex sync.RWMutex
+var templateCache = map[templateKey]string{}
+var templateCacheGeneration int // incremented when color codes change
+
+// compileTemplate returns format with its color templates replaced as by
+// processColorTemplates, caching the result, as the same format strings are
+// used over and over.
+func compileTemplate(colorTemplateRegexp *regexp.Regexp, theme string, format string) string {
+	key := templateKey{colorTemplateRegexp, theme, format}
+	templateCacheMutex.RLock()
+	compiled, ok := templateCache[key]
+	generation := templateCacheGeneration
+	templateCacheMutex.RUnlock()
+	if ok {
+		return compiled
+	}
+	compiled = string(processColorTemplates(colorTemplateRegexp, theme, []byte(format)))
+	templateCacheMutex.Lock()
+	defer templateCacheMutex.Unlock()
+	if generation != templateCacheGeneration {
+		// The color codes changed while compiling, so this may be stale
+		return compiled
+	}
+	if len(templateCache) >= maxCachedTemplates {
+		templateCache = map[templateKey]string{}
+	}
+	templateCache[key] = compiled
+	return compiled
+}
+
+// clearTemplateCache discards the compiled format strings, after a change to
+// the color codes that they may use.
+func clearTemplateCache() {
+	templateCacheMutex.Lock()
+	defer templateCacheMutex.Unlock()
+	templateCache = map[templateKey]string{}
+	templateCacheGeneration++
+}
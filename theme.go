@@ -0,0 +1,145 @@
+package alog
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Theme maps semantic color template codes, such as "error" in
+// @(error:failed), to styles. The built-in themes define error, warn,
+// success, info, muted, accent, path and number. Codes that a theme doesn't
+// define, like plain colors, are looked up as usual (see AddAnsiColorCode).
+type Theme map[string]ColorCode
+
+var themesMutex sync.RWMutex
+var themes = map[string]Theme{
+	"default": {
+		"error":   ColorRed,
+		"warn":    ColorYellow,
+		"success": ColorGreen,
+		"info":    ColorCyan,
+		"muted":   ColorBright | ColorBlack,
+		"accent":  ColorMagenta,
+		"path":    ColorBlue,
+		"number":  ColorCyan,
+	},
+	"high-contrast": {
+		"error":   ColorBright | ColorRed,
+		"warn":    ColorBright | ColorYellow,
+		"success": ColorBright | ColorGreen,
+		"info":    ColorBright | ColorCyan,
+		"muted":   ColorWhite,
+		"accent":  ColorBright | ColorMagenta,
+		"path":    ColorBright | ColorWhite,
+		"number":  ColorBright | ColorCyan,
+	},
+	// Avoids telling red and green apart; errors and successes differ in
+	// both hue and weight.
+	"colorblind-safe": {
+		"error":   ColorBright | ColorMagenta,
+		"warn":    ColorYellow,
+		"success": ColorBlue,
+		"info":    ColorCyan,
+		"muted":   ColorBright | ColorBlack,
+		"accent":  ColorBright | ColorWhite,
+		"path":    ColorCyan,
+		"number":  ColorBright | ColorBlue,
+	},
+	// Uses only weight, for terminals or readers without color.
+	"monochrome": {
+		"error":   ColorBright,
+		"warn":    ColorBright,
+		"success": ColorNone,
+		"info":    ColorNone,
+		"muted":   ColorDim,
+		"accent":  ColorBright,
+		"path":    ColorNone,
+		"number":  ColorNone,
+	},
+}
+
+// RegisterTheme adds a theme that can be selected by name with SetTheme,
+// replacing any theme of the same name, including the built-in ones:
+// "default", "high-contrast", "colorblind-safe" and "monochrome".
+func RegisterTheme(name string, theme Theme) {
+	themeCopy := Theme{}
+	for code, colorCode := range theme {
+		themeCopy[code] = colorCode
+	}
+	themesMutex.Lock()
+	themes[name] = themeCopy
+	themesMutex.Unlock()
+	clearTemplateCache()
+}
+
+// ThemeNames returns the names of the registered themes, sorted.
+func ThemeNames() []string {
+	themesMutex.RLock()
+	defer themesMutex.RUnlock()
+	var names []string
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupTheme(name string) (Theme, bool) {
+	themesMutex.RLock()
+	defer themesMutex.RUnlock()
+	theme, ok := themes[name]
+	return theme, ok
+}
+
+// lookupColorCode returns the style for the color template code name, from
+// the theme called theme, or the default theme if theme is empty, or else
+// from ansiColorCodes.
+func lookupColorCode(theme string, name string) (ColorCode, bool) {
+	if theme == "" {
+		theme = "default"
+	}
+	if styles, ok := lookupTheme(theme); ok {
+		if colorCode, ok := styles[name]; ok {
+			return colorCode, true
+		}
+	}
+	ansiColorCodesMutex.RLock()
+	defer ansiColorCodesMutex.RUnlock()
+	colorCode, ok := ansiColorCodes[name]
+	return colorCode, ok
+}
+
+// getTheme returns the name of the theme of l, or that of DefaultLogger, or ""
+// for the default theme.
+func (l *Logger) getTheme() string {
+	if l.theme != "" {
+		return l.theme
+	}
+	if DefaultLogger != nil {
+		return DefaultLogger.theme
+	}
+	return ""
+}
+
+// SetTheme selects the registered theme called name for the logger's color
+// templates, including its prefix. Loggers without a theme of their own use
+// that of DefaultLogger, which is initially set from the ALOG_THEME
+// environment variable (see Config).
+func (l *Logger) SetTheme(name string) error {
+	if _, ok := lookupTheme(name); !ok {
+		return fmt.Errorf("Unknown theme %q.", name)
+	}
+	ws := getWriterState(l.out)
+	ws.lock()
+	defer ws.unlock()
+	l.theme = name
+	l.reprocessPrefix()
+	return nil
+}
+
+// SetTheme selects the theme of the standard logger, which is also used by
+// Loggers that don't have one of their own.
+func SetTheme(name string) error {
+	return DefaultLogger.SetTheme(name)
+}